@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+//Parsed from the older-than, from and to options. Zero values mean there is no limit.
+var (
+	minIndexAge  time.Duration
+	fromIndexDay time.Time
+	toIndexDay   time.Time //The first time after the to option, as it takes in the whole of that day
+)
+
+//Parse the options that pick indexes by their date
+func parseAgeFilters() error {
+	var err error
+	minIndexAge = 0
+	if *olderThan != "" {
+		if minIndexAge, err = parseInterval(*olderThan); err != nil {
+			return fmt.Errorf("older than (older-than): %v", err)
+		}
+	}
+	if fromIndexDay, err = parseDay(*fromDate); err != nil {
+		return fmt.Errorf("from date (from): %v", err)
+	}
+	if toIndexDay, err = parseDay(*toDate); err != nil {
+		return fmt.Errorf("to date (to): %v", err)
+	}
+	if !toIndexDay.IsZero() {
+		toIndexDay = toIndexDay.AddDate(0, 0, 1)
+	}
+	if !fromIndexDay.IsZero() && !toIndexDay.IsZero() && !fromIndexDay.Before(toIndexDay) {
+		return fmt.Errorf("from date (from) must not be after to date (to)")
+	}
+	return nil
+}
+
+//Parse a date given as yyyy-mm-dd
+func parseDay(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+//Remove the indexes whose dates are outside the older-than, from and to options. Indexes without a date
+//are left for now, as when routing by the time field they get one later.
+func filterByDate(matchingIndexes elasticDailyIndexes) {
+	now := time.Now()
+	for idx, indexDate := range matchingIndexes {
+		if indexDate.IsZero() {
+			continue
+		}
+		if (minIndexAge > 0 && indexDate.After(now.Add(-minIndexAge))) ||
+			(!fromIndexDay.IsZero() && indexDate.Before(fromIndexDay)) ||
+			(!toIndexDay.IsZero() && !indexDate.Before(toIndexDay)) {
+			delete(matchingIndexes, idx)
+		}
+	}
+}
+
+//Remove the indexes that go into a destination whose period hasn't finished yet, such as the current
+//month, because more documents could still arrive for it. A destination is still open if it has the
+//same name as the destination for the current time. Returns the indexes that were removed.
+func skipOpenDestinations(matchingIndexes elasticDailyIndexes) []string {
+	var skipped []string
+	now := time.Now().UTC()
+	for idx, indexDate := range matchingIndexes {
+		for _, outIdxName := range destinationsOf(idx, indexDate) {
+			if outIdxName == destinationIndexName(idx, now) {
+				skipped = append(skipped, idx)
+				delete(matchingIndexes, idx)
+				break
+			}
+		}
+	}
+	return skipped
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+//The layout we use for the time range of an alias filter, which ElasticSearch understands by default
+const aliasTimeLayout = "2006-01-02T15:04:05Z07:00"
+
+//aliasRemoveIndexAction deletes an index as part of an aliases request. The vendored client doesn't
+//know about it, because it was added after ElasticSearch 2.x.
+type aliasRemoveIndexAction struct {
+	index string
+}
+
+func (a aliasRemoveIndexAction) Source() (interface{}, error) {
+	return map[string]interface{}{
+		"remove_index": map[string]interface{}{
+			"index": a.index,
+		},
+	}, nil
+}
+
+//Delete a source index and replace it with an alias of the same name on its destination index,
+//filtered to the time range that the source index covered. This means anything that searches the
+//old index name still finds the same documents.
+func replaceWithAlias(client *elastic.Client, idx, outIdxName string, indexDate time.Time) error {
+	filter := elastic.NewRangeQuery(*aliasField).
+		Gte(indexDate.Format(aliasTimeLayout)).
+		Lt(indexPeriodEnd(indexDate).Format(aliasTimeLayout))
+	addAlias := elastic.NewAliasAddAction(idx).Index(outIdxName).Filter(filter)
+
+	atomic, err := supportsRemoveIndex(client)
+	if err != nil {
+		return err
+	}
+
+	//Newer versions of ElasticSearch can delete the index and add the alias in one go, so there is no
+	//point where the name doesn't resolve. Older versions have to do it in two steps.
+	if atomic {
+		if _, err := client.Alias().Action(aliasRemoveIndexAction{index: idx}, addAlias).Do(); err != nil {
+			return err
+		}
+		log.Printf("Deleted %s and replaced it with an alias on %s", idx, outIdxName)
+		return nil
+	}
+
+	//If the alias can't be added (for example because aliasfield isn't mapped in the destination, which
+	//ElasticSearch checks filtered aliases against) we want to find out before the index is gone, so we
+	//try it out under another name first
+	if err := checkAlias(client, idx+"-rollup-alias-check", outIdxName, filter); err != nil {
+		return fmt.Errorf("could not add alias %s on %s, so %s has not been deleted: %v", idx, outIdxName, idx, err)
+	}
+	if _, err := client.DeleteIndex(idx).Do(); err != nil {
+		return err
+	}
+	log.Printf("Deleted %s", idx)
+	if _, err := client.Alias().Action(addAlias).Do(); err != nil {
+		return err
+	}
+	log.Printf("Added alias %s on %s", idx, outIdxName)
+	return nil
+}
+
+//Add a filtered alias and take it away again, to make sure that ElasticSearch will accept it
+func checkAlias(client *elastic.Client, alias, outIdxName string, filter elastic.Query) error {
+	if _, err := client.Alias().Action(elastic.NewAliasAddAction(alias).Index(outIdxName).Filter(filter)).Do(); err != nil {
+		return err
+	}
+	_, err := client.Alias().Action(elastic.NewAliasRemoveAction(alias).Index(outIdxName)).Do()
+	return err
+}
+
+//The aliases API can only delete indexes from ElasticSearch 5 onwards
+func supportsRemoveIndex(client *elastic.Client) (bool, error) {
+	version, err := client.ElasticsearchVersion(*inputHost)
+	if err != nil {
+		return false, fmt.Errorf("could not get ElasticSearch version: %v", err)
+	}
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		return false, fmt.Errorf("could not understand ElasticSearch version %s: %v", version, err)
+	}
+	return major >= 5, nil
+}
+
+//Work out when the period covered by an index ends, based on the smallest unit of time in the input
+//pattern. For example netflow-2006.01.02 covers a day, and netflow-2006.01 covers a month.
+func indexPeriodEnd(indexDate time.Time) time.Time {
+	name := indexDate.Format(*inputPattern)
+	for _, next := range []time.Time{
+		indexDate.Add(time.Hour),
+		indexDate.AddDate(0, 0, 1),
+		indexDate.AddDate(0, 1, 0),
+	} {
+		if next.Format(*inputPattern) != name {
+			return next
+		}
+	}
+	return indexDate.AddDate(1, 0, 0)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+//How many times a document that was rejected because the cluster was too busy is sent again, before we
+//give up on it and write it to the dead letter file
+const maxRejectedRetries = 5
+
+var (
+	retryInserter  *elastic.BulkProcessor //Where rejected documents are sent again
+	retryPending   int                    //Rejected documents that are waiting to be sent again
+	retriedCount   int                    //Documents that were rejected and sent again
+	rejectedRecent int                    //Documents rejected since adaptive last checked the clusters
+	retryMutex     sync.Mutex
+	inserterMutex  sync.RWMutex //Held while a rejected document is added to the inserter again, so that it isn't closed under us
+
+	bulkLimit      int    //The bulk size chosen by adaptive, or 0 if it isn't running
+	adaptiveStatus string //What adaptive last saw and did, for the progress table
+	adaptiveMutex  sync.Mutex
+)
+
+//Whether a bulk item or request failed because the cluster was too busy to take it
+func isRejection(status int, errorType string) bool {
+	return status == http.StatusTooManyRequests || errorType == "es_rejected_execution_exception"
+}
+
+//Send a rejected document to the bulk inserter again once it has waited a while, backing off a bit more
+//each time. If it has been tried too many times already, or the inserter is closing, this returns false
+//and it is up to the caller to deal with it. If the inserter closes while the document is waiting, it is
+//counted as unsent and written to the dead letter file as failed.
+func requeueRejected(r *rollupIndexRequest, failed deadLetter) bool {
+	retryMutex.Lock()
+	defer retryMutex.Unlock()
+	rejectedRecent++
+	if retryInserter == nil || r.Attempts >= maxRejectedRetries {
+		return false
+	}
+	r.Attempts++
+	retryPending++
+	retriedCount++
+	inserter := retryInserter
+	time.AfterFunc(time.Second<<uint(r.Attempts-1), func() {
+		inserterMutex.RLock()
+		retryMutex.Lock()
+		open := retryInserter == inserter
+		retryMutex.Unlock()
+		if open {
+			inserter.Add(r)
+		}
+		inserterMutex.RUnlock()
+
+		if !open {
+			deadLetterMutex.Lock()
+			unsentCount++
+			deadLetterMutex.Unlock()
+			writeDeadLetter(failed)
+		}
+		retryMutex.Lock()
+		retryPending--
+		retryMutex.Unlock()
+	})
+	return true
+}
+
+//Stop sending rejected documents to the bulk inserter, because it is about to be closed. Adding to a
+//closed inserter panics.
+func stopRetries() {
+	inserterMutex.Lock()
+	defer inserterMutex.Unlock()
+	retryMutex.Lock()
+	retryInserter = nil
+	retryMutex.Unlock()
+}
+
+//Flush the bulk inserter, and keep flushing until every rejected document that is waiting to be sent
+//again has been sent and accepted or given up on
+func flushWithRetries(bulkInserter *elastic.BulkProcessor) {
+	for {
+		bulkInserter.Flush()
+		retryMutex.Lock()
+		pending := retryPending
+		retryMutex.Unlock()
+		if pending == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+//The most documents to send in a single bulk request
+func currentBulkLimit() int {
+	adaptiveMutex.Lock()
+	defer adaptiveMutex.Unlock()
+	if bulkLimit == 0 {
+		return *bufferSize
+	}
+	return bulkLimit
+}
+
+//Check the thread pools of the clusters every so often while the rollup runs. If either cluster is
+//struggling, we halve the number of workers and the bulk size, and once it has recovered we raise them
+//again a bit at a time, up to the threads and buffersize options. Call the function that is returned to
+//stop checking.
+func startAdaptive(ctx context.Context, inClient, outClient *elastic.Client) func() {
+	adaptiveMutex.Lock()
+	bulkLimit = *bufferSize
+	adaptiveStatus = ""
+	adaptiveMutex.Unlock()
+	retryMutex.Lock()
+	rejectedRecent = 0
+	retryMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(adaptiveDelay)
+		defer ticker.Stop()
+		var last clusterLoad
+		checked := false
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			load, err := getClusterLoad(inClient, outClient)
+			if err != nil {
+				adaptiveMutex.Lock()
+				adaptiveStatus = err.Error()
+				adaptiveMutex.Unlock()
+				continue
+			}
+			retryMutex.Lock()
+			rejected := rejectedRecent
+			rejectedRecent = 0
+			retryMutex.Unlock()
+
+			//The thread pools count rejections from when the node started, so only a rise means anything
+			struggling := rejected > 0 ||
+				load.BulkQueue > *queueLimit ||
+				load.SearchQueue > *queueLimit ||
+				(checked && load.Rejected > last.Rejected)
+			last = load
+			checked = true
+			adjustLoad(struggling, load)
+		}
+	}()
+
+	return func() {
+		close(done)
+		adaptiveMutex.Lock()
+		bulkLimit = 0
+		adaptiveStatus = ""
+		adaptiveMutex.Unlock()
+	}
+}
+
+//Lower or raise the number of workers and the bulk size
+func adjustLoad(struggling bool, load clusterLoad) {
+	adaptiveMutex.Lock()
+	defer adaptiveMutex.Unlock()
+
+	minLimit := 10
+	if *bufferSize < minLimit {
+		minLimit = *bufferSize
+	}
+	p := currentPool()
+	workers := 0
+	if p != nil {
+		workers, _ = p.Size()
+	}
+
+	if struggling {
+		if p != nil {
+			p.Resize(workers / 2)
+		}
+		bulkLimit /= 2
+		if bulkLimit < minLimit {
+			bulkLimit = minLimit
+		}
+	} else {
+		if p != nil && workers < *threads {
+			p.Resize(workers + 1)
+		}
+		step := *bufferSize / 4
+		if step < 1 {
+			step = 1
+		}
+		bulkLimit += step
+		if bulkLimit > *bufferSize {
+			bulkLimit = *bufferSize
+		}
+	}
+	if p != nil {
+		workers, _ = p.Size()
+	}
+
+	state := "healthy"
+	if struggling {
+		state = "struggling"
+	}
+	adaptiveStatus = fmt.Sprintf("Cluster %s (bulk queue %d, search queue %d), using %d workers and a bulk size of %d",
+		state, load.BulkQueue, load.SearchQueue, workers, bulkLimit)
+}
+
+//Find the longest bulk queue on the destination cluster and search queue on the source cluster, and
+//how many requests their thread pools have rejected
+func getClusterLoad(inClient, outClient *elastic.Client) (clusterLoad, error) {
+	var load clusterLoad
+	pools := []struct {
+		client *elastic.Client
+		name   string
+		queue  *int
+	}{
+		{outClient, "bulk", &load.BulkQueue},
+		{inClient, "search", &load.SearchQueue},
+	}
+	for _, pool := range pools {
+		stats, err := pool.client.NodesStats().Metric("thread_pool").Do()
+		if err != nil {
+			return load, fmt.Errorf("could not get %s thread pool stats: %v", pool.name, err)
+		}
+		for _, node := range stats.Nodes {
+			threadPool := node.ThreadPool[pool.name]
+			if threadPool == nil {
+				continue
+			}
+			if threadPool.Queue > *pool.queue {
+				*pool.queue = threadPool.Queue
+			}
+			load.Rejected += threadPool.Rejected
+		}
+	}
+	return load, nil
+}
+
+//What adaptive is doing, for the progress table, or blank if it isn't running
+func adaptiveDescription() string {
+	adaptiveMutex.Lock()
+	defer adaptiveMutex.Unlock()
+	return adaptiveStatus
+}
@@ -44,8 +44,6 @@ func runBenchmark() {
 				*threads = thisThreads
 				*bufferSize = thisBuffers
 				//We need to reset some of our globals that will be maintained from our previous runs
-				runningThreads = 0
-				lastThread = 0
 				readDocs = make(map[string]rollupStat)
 
 				//You can set silent=true here if you do not want to display the individual runs of the benchmarks. I found
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//The things we can do with a field whose type differs between source indexes
+const (
+	conflictFail   = "fail"   //Refuse to roll up
+	conflictCoerce = "coerce" //Map the field as a single type and convert the values to suit
+	conflictRename = "rename" //Move the field to a new field named after its type, e.g. bytes_long
+	conflictDrop   = "drop"   //Remove the field altogether
+)
+
+//Parse a strategy as given on the command line, e.g. "drop" or "coerce:long"
+func parseConflictResolution(s string) (conflictResolution, error) {
+	parts := strings.SplitN(s, ":", 2)
+	r := conflictResolution{Action: parts[0]}
+	switch r.Action {
+	case conflictFail, conflictRename, conflictDrop:
+		if len(parts) > 1 {
+			return r, fmt.Errorf("%s does not take a type", r.Action)
+		}
+	case conflictCoerce:
+		if len(parts) < 2 || parts[1] == "" {
+			return r, fmt.Errorf("coerce needs a type to coerce to, e.g. coerce:long")
+		}
+		r.Type = parts[1]
+	default:
+		return r, fmt.Errorf("unknown conflict strategy %q", s)
+	}
+	return r, nil
+}
+
+//Parse the per-field overrides, given as a comma separated list of field=strategy pairs
+func parseFieldConflicts(s string) (map[string]conflictResolution, error) {
+	resolutions := make(map[string]conflictResolution)
+	if s == "" {
+		return resolutions, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return resolutions, fmt.Errorf("%q should be in the form field=strategy", pair)
+		}
+		r, err := parseConflictResolution(parts[1])
+		if err != nil {
+			return resolutions, fmt.Errorf("%s: %v", parts[0], err)
+		}
+		resolutions[parts[0]] = r
+	}
+	return resolutions, nil
+}
+
+//Compare the mappings of every source index that feeds each destination, and return the fields
+//that are mapped with different types. Each conflict has the resolution we are going to use for it.
+func findMappingConflicts(destinations map[string][]string, sourceMappings map[string]map[string]interface{}, defaultResolution conflictResolution, fieldResolutions map[string]conflictResolution) []fieldConflict {
+	var conflicts []fieldConflict
+
+	for outIdxName, sources := range destinations {
+		fields := make(map[string]*fieldConflict)
+		for _, idx := range sources {
+			for _, typeMapping := range sourceMappings[idx] {
+				typeMappingMap, _ := typeMapping.(map[string]interface{})
+				properties, _ := typeMappingMap["properties"].(map[string]interface{})
+				walkProperties(properties, "", func(path, fieldType string, mapping interface{}) {
+					field, ok := fields[path]
+					if !ok {
+						field = &fieldConflict{
+							DestinationIndex: outIdxName,
+							Field:            path,
+							Types:            make(map[string][]string),
+							Mappings:         make(map[string]interface{}),
+						}
+						fields[path] = field
+					}
+					//A field can appear in more than one document type in the same index, we only want to count the index once
+					seen := field.Types[fieldType]
+					if len(seen) == 0 || seen[len(seen)-1] != idx {
+						field.Types[fieldType] = append(seen, idx)
+					}
+					field.Mappings[fieldType] = mapping
+				})
+			}
+		}
+
+		for path, field := range fields {
+			if len(field.Types) < 2 {
+				continue
+			}
+			field.Resolution = defaultResolution
+			if r, ok := fieldResolutions[path]; ok {
+				field.Resolution = r
+			}
+			conflicts = append(conflicts, *field)
+		}
+	}
+
+	sort.Sort(fieldConflicts(conflicts))
+	return conflicts
+}
+
+//Walk through the properties of a mapping, calling fn with the full dotted path and type of every
+//field. Object fields are reported as well as the fields inside them.
+func walkProperties(properties map[string]interface{}, prefix string, fn func(path, fieldType string, mapping interface{})) {
+	for name, prop := range properties {
+		propMap, _ := prop.(map[string]interface{})
+		fieldType, _ := propMap["type"].(string)
+		children, hasChildren := propMap["properties"].(map[string]interface{})
+		if fieldType == "" && hasChildren {
+			fieldType = "object"
+		}
+		fn(prefix+name, fieldType, prop)
+		if hasChildren {
+			walkProperties(children, prefix+name+".", fn)
+		}
+	}
+}
+
+//Work out which fields need fixing in documents from each source index, keyed by source index
+func fieldFixesBySource(conflicts []fieldConflict) map[string][]fieldFix {
+	fixes := make(map[string][]fieldFix)
+	for _, conflict := range conflicts {
+		for fieldType, sources := range conflict.Types {
+			if conflict.Resolution.Action == conflictCoerce && conflict.Resolution.Type == fieldType {
+				continue //These documents are already the right type
+			}
+			for _, idx := range sources {
+				fixes[idx] = append(fixes[idx], fieldFix{
+					Field:      conflict.Field,
+					SourceType: fieldType,
+					Resolution: conflict.Resolution,
+				})
+			}
+		}
+	}
+	return fixes
+}
+
+//Change the merged mappings of a destination index so that they match what we are going to do with
+//the conflicting fields in each document
+func resolveMappingConflicts(mappings map[string]interface{}, conflicts []fieldConflict) {
+	for _, conflict := range conflicts {
+		path := strings.Split(conflict.Field, ".")
+		for _, typeMapping := range mappings {
+			typeMappingMap, _ := typeMapping.(map[string]interface{})
+			properties := mappingParentProperties(typeMappingMap, path)
+			name := path[len(path)-1]
+			if _, ok := properties[name]; !ok {
+				continue
+			}
+			switch conflict.Resolution.Action {
+			case conflictCoerce:
+				//If one of the sources already has it mapped as the type we want, keep the rest of that mapping
+				if mapping, ok := conflict.Mappings[conflict.Resolution.Type]; ok {
+					properties[name] = mapping
+				} else {
+					properties[name] = map[string]interface{}{"type": conflict.Resolution.Type}
+				}
+			case conflictDrop:
+				delete(properties, name)
+			case conflictRename:
+				delete(properties, name)
+				for fieldType, mapping := range conflict.Mappings {
+					properties[name+"_"+fieldType] = mapping
+				}
+			}
+		}
+	}
+}
+
+//Find the properties map that holds the last field in the path
+func mappingParentProperties(typeMapping map[string]interface{}, path []string) map[string]interface{} {
+	properties, _ := typeMapping["properties"].(map[string]interface{})
+	for _, name := range path[:len(path)-1] {
+		prop, _ := properties[name].(map[string]interface{})
+		properties, _ = prop["properties"].(map[string]interface{})
+	}
+	return properties
+}
+
+//Find the field in the document and fix it. Objects inside arrays are each fixed in turn.
+func fixField(doc map[string]interface{}, path []string, fix fieldFix) {
+	name := path[0]
+	value, ok := doc[name]
+	if !ok {
+		return
+	}
+
+	if len(path) > 1 {
+		switch child := value.(type) {
+		case map[string]interface{}:
+			fixField(child, path[1:], fix)
+		case []interface{}:
+			for _, element := range child {
+				if elementMap, ok := element.(map[string]interface{}); ok {
+					fixField(elementMap, path[1:], fix)
+				}
+			}
+		}
+		return
+	}
+
+	switch fix.Resolution.Action {
+	case conflictCoerce:
+		doc[name] = coerceValue(value, fix.Resolution.Type)
+	case conflictDrop:
+		delete(doc, name)
+	case conflictRename:
+		delete(doc, name)
+		doc[name+"_"+fix.SourceType] = value
+	}
+}
+
+//Convert a value to suit the given ElasticSearch type as best we can. If it can't be converted it
+//is left alone, and ElasticSearch will reject the document.
+func coerceValue(value interface{}, fieldType string) interface{} {
+	if values, ok := value.([]interface{}); ok {
+		for i := range values {
+			values[i] = coerceValue(values[i], fieldType)
+		}
+		return values
+	}
+
+	if converted, err := convertValue(value, fieldType); err == nil {
+		return converted
+	}
+	return value
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+//Listen for changes to a running rollup over HTTP. This runs for as long as the program does, so in a
+//config file of jobs it changes whichever job is running.
+func startControlServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/workers", controlWorkers)
+	mux.HandleFunc("/rate", controlRate)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Control server stopped: %v", err)
+		}
+	}()
+}
+
+//GET /workers shows the number of workers, and POST /workers?n=5 changes it
+func controlWorkers(w http.ResponseWriter, r *http.Request) {
+	p := currentPool()
+	if p == nil {
+		http.Error(w, "Nothing is being rolled up", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		n, err := strconv.Atoi(r.FormValue("n"))
+		if err != nil || n < 1 {
+			http.Error(w, "n must be a whole number of 1 or more", http.StatusBadRequest)
+			return
+		}
+		p.Resize(n)
+	default:
+		http.Error(w, "Use GET, or POST with n", http.StatusMethodNotAllowed)
+		return
+	}
+	size, busy := p.Size()
+	fmt.Fprintf(w, "%d workers, %d busy\n", size, busy)
+}
+
+//GET /rate shows the throttle, and POST /rate?docs=1000&bytes=1000000 changes it. Either can be left out
+//to leave it as it is, and 0 turns it off.
+func controlRate(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		limits := map[string]*rateLimiter{"docs": docLimiter, "bytes": byteLimiter}
+		rates := make(map[string]int)
+		for name := range limits {
+			value := r.FormValue(name)
+			if value == "" {
+				continue
+			}
+			rate, err := strconv.Atoi(value)
+			if err != nil || rate < 0 {
+				http.Error(w, name+" must be a whole number of 0 or more", http.StatusBadRequest)
+				return
+			}
+			rates[name] = rate
+		}
+		if len(rates) == 0 {
+			http.Error(w, "Give docs, bytes or both", http.StatusBadRequest)
+			return
+		}
+		for name, rate := range rates {
+			limits[name].SetRate(rate)
+		}
+	default:
+		http.Error(w, "Use GET, or POST with docs and bytes", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(w, "%d documents/sec, %d bytes/sec (0 is no limit)\n", docLimiter.Rate(), byteLimiter.Rate())
+}
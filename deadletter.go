@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+var (
+	deadLetterOut   *json.Encoder //Where failed documents are written, if we have been asked to keep them
+	deadLetterCount int
+	skippedCount    int //Documents that failed a transform or couldn't be summarized, and were never sent to ElasticSearch
+	unsentCount     int //Documents that were still in a bulk request that couldn't be sent at all when the inserter closed
+	deadLetterMutex sync.Mutex
+
+	//Documents whose last bulk request failed as a whole, e.g. because the cluster couldn't be reached. The
+	//bulk processor keeps them and sends them again with its next commit, so we only treat them as failed
+	//if they are still here when it is closed.
+	unsentRequests = make(map[*rollupIndexRequest]deadLetter)
+)
+
+//rollupIndexRequest is a bulk index request that remembers where its document came from, so that if
+//it fails we can write everything we know about it to the dead letter file
+type rollupIndexRequest struct {
+	*elastic.BulkIndexRequest
+	SourceIndex      string
+	DestinationIndex string
+	Type             string
+	Id               string
+	Doc              *json.RawMessage
+	Attempts         int //How many times it has been sent again after being rejected by a busy cluster
+}
+
+//Build the bulk request for a single document
+func newRollupIndexRequest(sourceIndex, destinationIndex, docType, id string, doc *json.RawMessage) *rollupIndexRequest {
+	request := elastic.NewBulkIndexRequest(). //Index the document
+							Index(destinationIndex). //Destination index
+							Type(docType).           //Document type
+							Id(id).                  //Document ID to prevent doubleups
+							Doc(doc)                 //Original JSON document
+	return &rollupIndexRequest{
+		BulkIndexRequest: request,
+		SourceIndex:      sourceIndex,
+		DestinationIndex: destinationIndex,
+		Type:             docType,
+		Id:               id,
+		Doc:              doc,
+	}
+}
+
+//Open the dead letter file. We append to it, so that failures from earlier runs aren't lost.
+func openDeadLetter(path string) (io.Closer, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deadLetterMutex.Lock()
+	deadLetterOut = json.NewEncoder(f)
+	deadLetterCount = 0
+	deadLetterMutex.Unlock()
+	return f, nil
+}
+
+//Stop writing to the dead letter file
+func closeDeadLetter(f io.Closer) {
+	deadLetterMutex.Lock()
+	deadLetterOut = nil
+	deadLetterMutex.Unlock()
+	f.Close()
+}
+
+//This is called by the bulk processor after every commit. Documents that were rejected because the
+//cluster was too busy are sent again after a while. Any other documents that failed are written to the
+//dead letter file, one JSON object per line. If the whole commit failed then the bulk processor will
+//send it again, so the documents are only remembered until closeBulkInserter.
+func bulkAfter(executionId int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+	for i, request := range requests {
+		r, ok := request.(*rollupIndexRequest)
+		if !ok {
+			continue
+		}
+		failed := deadLetter{
+			SourceIndex:      r.SourceIndex,
+			DestinationIndex: r.DestinationIndex,
+			Id:               r.Id,
+			Type:             r.Type,
+			Doc:              r.Doc,
+			Transformed:      true,
+		}
+
+		if err != nil {
+			failed.ErrorType = "bulk_error"
+			failed.ErrorReason = err.Error()
+			deadLetterMutex.Lock()
+			unsentRequests[r] = failed
+			deadLetterMutex.Unlock()
+			continue
+		}
+		deadLetterMutex.Lock()
+		delete(unsentRequests, r) //It has been sent now, whatever happened to it
+		deadLetterMutex.Unlock()
+
+		item := bulkResponseItem(response, i)
+		if item == nil || (item.Status >= 200 && item.Status <= 299) {
+			continue
+		}
+		failed.ErrorType = fmt.Sprintf("status_%d", item.Status)
+		if item.Error != nil {
+			failed.ErrorType = item.Error.Type
+			failed.ErrorReason = item.Error.Reason
+		}
+		if isRejection(item.Status, failed.ErrorType) && requeueRejected(r, failed) {
+			continue
+		}
+
+		writeDeadLetter(failed)
+	}
+}
+
+//Close the bulk inserter. Anything that it still couldn't send on its last attempt is dropped by it, so
+//this is where those documents are counted as failed and written to the dead letter file, once each.
+func closeBulkInserter(bulkInserter *elastic.BulkProcessor) {
+	stopRetries()
+	bulkInserter.Close()
+	deadLetterMutex.Lock()
+	unsent := unsentRequests
+	unsentRequests = make(map[*rollupIndexRequest]deadLetter)
+	unsentCount += len(unsent)
+	deadLetterMutex.Unlock()
+	for _, failed := range unsent {
+		writeDeadLetter(failed)
+	}
+}
+
+//Whether there are documents that the bulk processor is still waiting to send again, because their
+//whole bulk request failed
+func unsentWaiting() bool {
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+	return len(unsentRequests) > 0
+}
+
+//Write a single failed document to the dead letter file, if we have one
+func writeDeadLetter(failed deadLetter) {
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+	if deadLetterOut == nil {
+		return
+	}
+	if err := deadLetterOut.Encode(failed); err != nil {
+		consoleOut("Could not write to dead letter file: %v\n", err)
+		return
+	}
+	deadLetterCount++
+}
+
+//Record a document that we couldn't transform or summarize. It is written to the dead letter file with
+//its original source, so that it can be replayed once the problem has been fixed.
+func skipDocument(sourceIndex, destinationIndex, docType, id string, doc *json.RawMessage, errorType string, err error) {
+	deadLetterMutex.Lock()
+	skippedCount++
+	deadLetterMutex.Unlock()
+	writeDeadLetter(deadLetter{
+		SourceIndex:      sourceIndex,
+		DestinationIndex: destinationIndex,
+		Id:               id,
+		Type:             docType,
+		ErrorType:        errorType,
+		ErrorReason:      err.Error(),
+		Doc:              doc,
+	})
+}
+
+//Find the result of the i'th request in a bulk response. The items come back in the same order as the
+//requests, each keyed by its action.
+func bulkResponseItem(response *elastic.BulkResponse, i int) *elastic.BulkResponseItem {
+	if response == nil || i >= len(response.Items) {
+		return nil
+	}
+	for _, item := range response.Items[i] {
+		return item
+	}
+	return nil
+}
+
+//Tell the user how many documents didn't make it, and where they went
+func printDeadLetterSummary() {
+	if skippedCount > 0 {
+		consoleOut("%d documents could not be routed, transformed or summarized and were not indexed\n", skippedCount)
+	}
+	if retriedCount > 0 {
+		consoleOut("%d documents were rejected by a busy cluster and sent again. They are also counted as failed above\n", retriedCount)
+	}
+	if unsentCount > 0 {
+		consoleOut("%d documents could not be sent to ElasticSearch at all. They are not counted as failed above\n", unsentCount)
+	}
+	if deadLetterCount > 0 {
+		consoleOut("%d failed documents written to %s\n", deadLetterCount, *deadLetters)
+	}
+}
+
+//Send every document in a dead letter file to ElasticSearch again, and turn the result into an exit
+//code for main
+func doReplay() int {
+	outHost := outputHostOrDefault()
+	if *deadLetters == *replayFile {
+		fmt.Println("Dead letter file (deadletter) cannot be the same file that is being replayed")
+		return 1
+	}
+
+	f, err := os.Open(*replayFile)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer f.Close()
+
+	if err := loadTransformChain(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	if *deadLetters != "" {
+		deadLetter, err := openDeadLetter(*deadLetters)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer closeDeadLetter(deadLetter)
+	}
+
+	consoleOut("Creating write client...")
+	outClient, err := elastic.NewSimpleClient(elastic.SetURL(outHost))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	consoleOut("Done\n")
+
+	consoleOut("Creating bulk inserter...")
+	bulkInserter, err := newBulkInserter(outClient)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	consoleOut("Done\n")
+
+	consoleOut("Replaying %s...", *replayFile)
+	reader := bufio.NewReader(f)
+	for runContext.Err() == nil { //If we are asked to stop, whatever has been replayed so far is still flushed
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var failed deadLetter
+			if err := json.Unmarshal(line, &failed); err != nil {
+				fmt.Println("Could not read dead letter file:", err)
+				return 1
+			}
+			source := failed.Doc
+			var transformErr error
+			if failed.DestinationIndex != "" && !failed.Transformed { //Documents that failed in ElasticSearch were transformed before they were sent
+				source, transformErr = processDocument(failed.SourceIndex, failed.Doc, 0)
+			}
+			if failed.DestinationIndex == "" { //It couldn't be routed by its time field, so there is nowhere to send it
+				skipDocument(failed.SourceIndex, "", failed.Type, failed.Id, failed.Doc, "route_error", fmt.Errorf("document has no destination index"))
+			} else if transformErr != nil {
+				skipDocument(failed.SourceIndex, failed.DestinationIndex, failed.Type, failed.Id, failed.Doc, "transform_error", transformErr)
+			} else if throttle(runContext, source) == nil { //If it isn't nil we are stopping, so the document is left for next time
+				bulkInserter.Add(newRollupIndexRequest(failed.SourceIndex, failed.DestinationIndex, failed.Type, failed.Id, source))
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	flushWithRetries(bulkInserter)
+	closeBulkInserter(bulkInserter)
+	consoleOut("Done\n")
+
+	stats := bulkInserter.Stats()
+	consoleOut("Number of requests reported as success: %d\n", stats.Succeeded)
+	consoleOut("Number of requests reported as failed : %d\n", stats.Failed)
+	printDeadLetterSummary()
+	if stats.Failed > int64(retriedCount) || skippedCount > 0 || unsentCount > 0 || runContext.Err() != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+//Split a comma separated list of field patterns, ignoring any blanks
+func fieldList(s string) []string {
+	var fields []string
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+//The fields we want from each document. When summarizing we only need the fields in the summary file,
+//unless there are transforms, which could be making those fields out of others.
+func projectedFields() (includes, excludes []string) {
+	includes = fieldList(*includeFields)
+	excludes = fieldList(*excludeFields)
+	if summary != nil && len(transformChain) == 0 && len(includes) == 0 {
+		includes = summary.fields()
+	}
+	return includes, excludes
+}
+
+//Whether a field will be in the documents we read, given the fields we are rolling up
+func fieldRolledUp(field string) bool {
+	includes, excludes := projectedFields()
+	return (len(includes) == 0 || matchesAnyField(includes, field)) && !matchesAnyField(excludes, field)
+}
+
+//Build the source filter for our scrolls from the fields we want, so that fields we don't want are never
+//sent to us in the first place. It returns nil if we want everything.
+func sourceFilter() *elastic.FetchSourceContext {
+	includes, excludes := projectedFields()
+	if len(includes) == 0 && len(excludes) == 0 {
+		return nil
+	}
+	return elastic.NewFetchSourceContext(true).Include(includes...).Exclude(excludes...)
+}
+
+//Remove the fields that aren't being rolled up from the mappings of every source index, so that they
+//don't end up in the destination mappings and we don't complain about them conflicting
+func projectSourceMappings(sourceMappings map[string]map[string]interface{}) {
+	includes, excludes := projectedFields()
+	if len(includes) == 0 && len(excludes) == 0 {
+		return
+	}
+	for _, typeMappings := range sourceMappings {
+		for _, typeMapping := range typeMappings {
+			typeMappingMap, _ := typeMapping.(map[string]interface{})
+			properties, _ := typeMappingMap["properties"].(map[string]interface{})
+			projectProperties(properties, "", len(includes) == 0, includes, excludes)
+		}
+	}
+}
+
+//Remove the fields from a mapping that are excluded, or aren't included. A field is included if it or
+//any object it is inside matches an include pattern, and objects are kept if anything inside them is.
+func projectProperties(properties map[string]interface{}, prefix string, parentIncluded bool, includes, excludes []string) {
+	for name, prop := range properties {
+		path := prefix + name
+		if matchesAnyField(excludes, path) {
+			delete(properties, name)
+			continue
+		}
+
+		included := parentIncluded || matchesAnyField(includes, path)
+		propMap, _ := prop.(map[string]interface{})
+		if children, ok := propMap["properties"].(map[string]interface{}); ok {
+			projectProperties(children, path+".", included, includes, excludes)
+			if !included && len(children) == 0 {
+				delete(properties, name)
+			}
+			continue
+		}
+		if !included {
+			delete(properties, name)
+		}
+	}
+}
+
+//Check a dotted field path against a list of patterns, where * matches anything (including dots)
+func matchesAnyField(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		expr := "^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1) + "$"
+		if matched, _ := regexp.MatchString(expr, path); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+//Flags that only make sense on the command line, and can't be given to a job
+var commandLineOnlyFlags = map[string]bool{
+	"config":  true,
+	"job":     true,
+	"control": true,
+}
+
+//Load a config file of jobs. Each job is an object whose keys are the names of command line options,
+//along with a name for the job.
+func loadJobConfig(path string) (jobConfig, error) {
+	var config jobConfig
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	var raw struct {
+		Threads  int                      `json:"threads"`
+		Defaults map[string]interface{}   `json:"defaults"`
+		Jobs     []map[string]interface{} `json:"jobs"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return config, err
+	}
+
+	config.Threads = raw.Threads
+	if config.Defaults, err = jobFlags(raw.Defaults); err != nil {
+		return config, fmt.Errorf("defaults: %v", err)
+	}
+	names := make(map[string]bool)
+	for i, settings := range raw.Jobs {
+		name, _ := settings["name"].(string)
+		if name == "" {
+			return config, fmt.Errorf("job %d has no name", i+1)
+		}
+		if names[name] {
+			return config, fmt.Errorf("there is more than one job named %s", name)
+		}
+		names[name] = true
+		delete(settings, "name")
+
+		job := rollupJob{Name: name}
+		if job.Flags, err = jobFlags(settings); err != nil {
+			return config, fmt.Errorf("job %s: %v", name, err)
+		}
+		config.Jobs = append(config.Jobs, job)
+	}
+	return config, nil
+}
+
+//Turn the settings of a job into the same strings that would be given on the command line
+func jobFlags(settings map[string]interface{}) (map[string]string, error) {
+	flags := make(map[string]string)
+	for name, value := range settings {
+		if flag.Lookup(name) == nil || commandLineOnlyFlags[name] {
+			return flags, fmt.Errorf("%s is not an option that can be set for a job", name)
+		}
+		switch v := value.(type) {
+		case float64:
+			flags[name] = strconv.FormatFloat(v, 'f', -1, 64) //So that 1000000 doesn't become 1e+06
+		case string, bool:
+			flags[name] = fmt.Sprint(value)
+		default:
+			return flags, fmt.Errorf("%s must be a string, number or true/false", name)
+		}
+	}
+	return flags, nil
+}
+
+//Run the jobs in the config file one after another, or just the ones picked with the job option. Each
+//job starts from the default options, then the config file's defaults, then its own settings. Anything
+//given on the command line overrides all of those, e.g. to plan every job.
+func doJobs() int {
+	config, err := loadJobConfig(*configFile)
+	if err != nil {
+		fmt.Println("Config file (config) could not be loaded:", err)
+		return 1
+	}
+
+	jobs := config.Jobs
+	if selected := fieldList(*jobNames); len(selected) > 0 {
+		byName := make(map[string]rollupJob)
+		for _, job := range config.Jobs {
+			byName[job.Name] = job
+		}
+		jobs = nil
+		for _, name := range selected {
+			job, ok := byName[name]
+			if !ok {
+				fmt.Printf("There is no job named %s in %s\n", name, *configFile)
+				return 1
+			}
+			jobs = append(jobs, job)
+		}
+	}
+	if len(jobs) == 0 {
+		fmt.Println("There are no jobs to run")
+		return 1
+	}
+
+	commandLine := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		if !commandLineOnlyFlags[f.Name] {
+			commandLine[f.Name] = f.Value.String()
+		}
+	})
+
+	var results []jobResult
+	for _, job := range jobs {
+		if runContext.Err() != nil { //We have been asked to stop, so don't start anything else
+			fmt.Printf("Stopped before job %s was run\n", job.Name)
+			break
+		}
+		consoleOut("Running job %s\n", job.Name)
+		start := time.Now()
+		exitCode := 1
+		if err := setJobFlags(config, job, commandLine); err != nil {
+			fmt.Printf("Job %s has an invalid option: %v\n", job.Name, err)
+		} else {
+			resetJobState()
+			exitCode = runOnce()
+		}
+		results = append(results, jobResult{
+			Name:     job.Name,
+			ExitCode: exitCode,
+			Elapsed:  time.Since(start),
+		})
+	}
+
+	printJobTable(results)
+	for _, result := range results {
+		if result.ExitCode != 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+//Set every option for a job. The config file's threads setting is a budget shared by all the jobs, so
+//no job can use more threads than it.
+func setJobFlags(config jobConfig, job rollupJob, commandLine map[string]string) error {
+	flag.VisitAll(func(f *flag.Flag) {
+		if !commandLineOnlyFlags[f.Name] {
+			f.Value.Set(f.DefValue) //Our own defaults can always be set back, so there's no error to check
+		}
+	})
+	for _, flags := range []map[string]string{config.Defaults, job.Flags, commandLine} {
+		for name, value := range flags {
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	if config.Threads > 0 && *threads > config.Threads {
+		*threads = config.Threads
+	}
+	return nil
+}
+
+//Put back all the globals that a previous job will have changed
+func resetJobState() {
+	readDocs = make(map[string]rollupStat)
+	fieldFixes = make(map[string][]fieldFix)
+	rollupQuery = nil
+	transformChain = nil
+	summary = nil
+	sampleRules = nil
+	timeDestinations = nil
+	untimedDocs = nil
+	inputRegex = nil
+	outputTemplate = nil
+	deadLetterCount = 0
+	skippedCount = 0
+	unsentCount = 0
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -13,6 +14,7 @@ import (
 	"strings"
 
 	elastic "gopkg.in/olivere/elastic.v3"
+	"gopkg.in/olivere/elastic.v3/backoff"
 )
 
 var (
@@ -24,17 +26,66 @@ var (
 	threads       = flag.Int("threads", 3, "Number of worker threads to process. Each thread will process one day at a time.")
 	bufferSize    = flag.Int("buffersize", 1000, "Number of records to insert at any given time")
 	benchmark     = flag.Bool("benchmark", false, "Run benchmarks with different sized threads and buffers")
+	stateFile     = flag.String("state", "", "(optional) File to record the progress of each source index in, so that an interrupted rollup can be resumed")
+	resume        = flag.Bool("resume", false, "Resume a previous rollup from the file given in the state option. Completed indexes are skipped and in-progress indexes carry on from where they stopped")
+	verify        = flag.Bool("verify", false, "Compare the document counts of the source and destination indexes once the rollup has finished, and exit non-zero if they differ")
+	createIndexes = flag.Bool("createindexes", true, "Create destination indexes with the merged mappings and settings of their source indexes before writing to them. Set to false to let ElasticSearch create them from the first document written")
+	onConflict    = flag.String("onconflict", "fail", "What to do with fields that are mapped as different types in different source indexes: fail, drop, rename (to field_type) or coerce:type")
+	conflictRules = flag.String("fieldconflicts", "", "(optional) Comma separated list of field=strategy pairs that override onconflict for individual fields, e.g. bytes=coerce:long,payload=drop")
+	shards        = flag.Int("shards", 0, "(optional) Number of shards for new destination indexes. If zero, uses the setting from the source indexes")
+	replicas      = flag.Int("replicas", -1, "(optional) Number of replicas for new destination indexes. If negative, uses the setting from the source indexes")
+	plan          = flag.Bool("plan", false, "Show which indexes would be rolled up into which destinations, without writing anything")
+	planFormat    = flag.String("planformat", "table", "Format to show the plan in: table or json")
+	onSuccess     = flag.String("onsuccess", "", "(optional) What to do with source indexes once their destination has passed verification: close, delete or snapshot (snapshot then delete)")
+	snapshotRepo  = flag.String("snapshotrepo", "", "Snapshot repository to use when onsuccess is snapshot")
+	gracePeriod   = flag.Duration("grace", 0, "(optional) Only close or delete source indexes whose date is at least this long ago, e.g. 720h")
+	assumeYes     = flag.Bool("yes", false, "Don't ask for confirmation before closing or deleting source indexes")
+	aliasCutover  = flag.Bool("alias", false, "When source indexes are deleted by onsuccess, replace each one with an alias of the same name on its destination index, filtered to the time range of the source index")
+	aliasField    = flag.String("aliasfield", "@timestamp", "The timestamp field to filter aliases on")
+	deadLetters   = flag.String("deadletter", "", "(optional) File to write documents that could not be indexed to, one JSON object per line")
+	replayFile    = flag.String("replay", "", "Send the documents in a dead letter file to ElasticSearch again, instead of rolling anything up")
+	queryString   = flag.String("query", "", "(optional) Only roll up documents that match this query. Either a query_string expression or a JSON query")
+	includeFields = flag.String("include-fields", "", "(optional) Comma separated list of fields to roll up, which can contain * wildcards. If blank, all fields are rolled up")
+	excludeFields = flag.String("exclude-fields", "", "(optional) Comma separated list of fields not to roll up, which can contain * wildcards")
+	summarizeFile = flag.String("summarize", "", "(optional) JSON file describing summary documents to write instead of copying documents")
+	olderThan     = flag.String("older-than", "", "(optional) Only roll up indexes whose date is at least this old, e.g. 30d, 2w or 12h")
+	fromDate      = flag.String("from", "", "(optional) Only roll up indexes whose date is on or after this day, as yyyy-mm-dd")
+	toDate        = flag.String("to", "", "(optional) Only roll up indexes whose date is on or before this day, as yyyy-mm-dd")
+	includeOpen   = flag.Bool("includeopen", false, "Roll up indexes into destinations whose period hasn't finished yet, such as the current month. These are skipped by default")
+	readOrder     = flag.String("order", orderName, "Order to read source indexes in: name, largest (biggest first) or destination (grouped by destination)")
+	maxDocsRate   = flag.Int("max-docs-per-sec", 0, "(optional) The most documents per second to send to the destination, across all the threads. If zero, there is no limit")
+	maxBytesRate  = flag.Int("max-bytes-per-sec", 0, "(optional) The most bytes of documents per second to send to the destination, across all the threads. If zero, there is no limit")
+	adaptive      = flag.Bool("adaptive", false, "Watch the thread pools of the clusters while rolling up, and use fewer threads and smaller bulk requests while either cluster is struggling")
+	queueLimit    = flag.Int("queuelimit", 20, "With adaptive, a cluster is struggling if any node has more than this many bulk or search requests queued")
+	controlAddr   = flag.String("control", "", "(optional) Address to listen on for changes while running, e.g. localhost:9900. See the README for what can be changed")
+	configFile    = flag.String("config", "", "(optional) JSON file of named jobs to run one after another, each with its own options")
+	jobNames      = flag.String("job", "", "(optional) Comma separated list of the jobs in the config file to run. If blank, every job is run")
+	splitBy       = flag.String("split", "", "(optional) Read each source index in parts at the same time: shards (one part for each primary shard) or time (equal time ranges of splitfield)")
+	splitParts    = flag.Int("splitparts", 4, "Number of time ranges to read each source index in when split is time")
+	splitField    = flag.String("splitfield", "@timestamp", "The timestamp field to split source indexes on when split is time")
+	timeField     = flag.String("timefield", "", "(optional) Route each document to a destination index by the time in this field, instead of by the date in its source index name")
+	sampleRates   = flag.String("sample", "", "(optional) Only keep 1 in every N documents. Either N, or a comma separated list of destination=N where destination can contain * wildcards")
+	sampleField   = flag.String("samplefield", "", "(optional) Field to choose the sample by. If blank, the document ID is used")
+	transformFile = flag.String("transforms", "", "(optional) JSON file with a list of transforms to apply to every document, in order")
+	verifyOnly    = flag.Bool("verifyonly", false, "Only compare the document counts of the source and destination indexes, without rolling anything up")
 
 	silent = false
 
-	runningThreads = 0
-	lastThread     = 0
-	readDocs       = make(map[string]rollupStat)
+	inputRegex       *regexp.Regexp //Compiled from the infilter option
+	readDocs         = make(map[string]rollupStat)
+	fieldFixes       = make(map[string][]fieldFix) //Changes to make to the documents from each source index to resolve mapping conflicts
+	rollupQuery      elastic.Query                 //Parsed from the query option, nil if we are rolling up everything
+	transformChain   []transformStep               //Loaded from the transforms file
+	summary          *summarySpec                  //Loaded from the summarize file, nil if we are copying documents
+	sampleRules      []sampleRule                  //Parsed from the sample option
+	timeDestinations map[string]map[string]int64   //Source index -> destination index -> documents, when routing by the time field
+	untimedDocs      map[string]int64              //Source index -> documents without the time field, which can't be routed
 
-	delay = time.Second
+	delay           = time.Second
+	checkpointDelay = 30 * time.Second //How often we write out the state file
+	adaptiveDelay   = 10 * time.Second //How often adaptive checks the thread pools of the clusters
 
-	runningMutex sync.Mutex
-	readMutex    sync.Mutex
+	readMutex sync.Mutex
 )
 
 func doMain() int {
@@ -48,8 +99,9 @@ func doMain() int {
 		fmt.Println("Input filter could not be compiled to a regex:", err)
 		return 1
 	}
-	if *inputPattern == "" {
-		fmt.Println("Input pattern (inpattern) cannot be blank")
+	inputRegex = inputPatternRegex
+	if *inputPattern == "" && *timeField == "" {
+		fmt.Println("Input pattern (inpattern) cannot be blank unless a time field (timefield) is given")
 		return 1
 	}
 
@@ -57,18 +109,151 @@ func doMain() int {
 		fmt.Println("Output pattern (outpattern) cannot be blank")
 		return 1
 	}
+	if err := parseOutputPattern(); err != nil {
+		fmt.Println("Output pattern (outpattern) is not valid:", err)
+		return 1
+	}
 
 	if *inputHost == "" {
 		fmt.Println("Input host (inhost) cannot be blank")
 		return 1
 	}
-	if *outputHost == "" { //Output host defaults to input host if not specified
-		outputHost = inputHost
-	}
+	outHost := outputHostOrDefault()
 	if *threads == 0 {
 		fmt.Println("Thread count (threads) must be above zero")
 		return 1
 	}
+	defaultResolution, err := parseConflictResolution(*onConflict)
+	if err != nil {
+		fmt.Println("Conflict strategy (onconflict) is not valid:", err)
+		return 1
+	}
+	fieldResolutions, err := parseFieldConflicts(*conflictRules)
+	if err != nil {
+		fmt.Println("Field conflict strategies (fieldconflicts) are not valid:", err)
+		return 1
+	}
+	if *planFormat != "table" && *planFormat != "json" {
+		fmt.Println("Plan format (planformat) must be table or json")
+		return 1
+	}
+	switch *onSuccess {
+	case "", retireClose, retireDelete:
+	case retireSnapshot:
+		if *snapshotRepo == "" {
+			fmt.Println("Snapshot repository (snapshotrepo) must be specified to snapshot source indexes")
+			return 1
+		}
+	default:
+		fmt.Println("On success action (onsuccess) must be close, delete or snapshot")
+		return 1
+	}
+	if *aliasCutover && *onSuccess != retireDelete && *onSuccess != retireSnapshot {
+		fmt.Println("Aliases (alias) can only replace source indexes that are deleted, onsuccess must be delete or snapshot")
+		return 1
+	}
+	if *aliasCutover && outHost != *inputHost {
+		fmt.Println("Aliases (alias) can only be used when the source and destination indexes are on the same host")
+		return 1
+	}
+	if *onSuccess != "" && *benchmark {
+		fmt.Println("On success action (onsuccess) cannot be used with benchmark")
+		return 1
+	}
+	rollupQuery, err = parseQuery(*queryString)
+	if err != nil {
+		fmt.Println("Query (query) is not valid:", err)
+		return 1
+	}
+	if rollupQuery != nil && (*onSuccess == retireDelete || *onSuccess == retireSnapshot) {
+		//Verification only counts the documents that match the query, so it would pass while the
+		//documents that didn't match are deleted along with the source indexes
+		fmt.Println("Source indexes can't be deleted (onsuccess delete or snapshot) when only some of their documents are rolled up (query)")
+		return 1
+	}
+	if err := loadTransformChain(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if err := loadSummary(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if summary != nil && *aliasCutover {
+		fmt.Println("Aliases (alias) cannot be used with summarize, as the destination documents are not the source documents")
+		return 1
+	}
+	if *timeField != "" && *aliasCutover {
+		fmt.Println("Aliases (alias) cannot be used with timefield, as the documents of a source index can be in more than one destination")
+		return 1
+	}
+	if *timeField != "" && summary != nil && summary.TimestampField != *timeField {
+		fmt.Println("The summary timestamp_field must be the same as the time field (timefield)")
+		return 1
+	}
+	if *timeField != "" && !fieldRolledUp(*timeField) { //Documents are routed by their source after it has been filtered
+		fmt.Println("Time field (timefield) must be one of the fields being rolled up")
+		return 1
+	}
+	sampleRules, err = parseSampleRules(*sampleRates)
+	if err != nil {
+		fmt.Println("Sample rates (sample) are not valid:", err)
+		return 1
+	}
+	if len(sampleRules) > 0 {
+		if summary != nil {
+			fmt.Println("Sample rates (sample) cannot be used with summarize")
+			return 1
+		}
+		if *verify || *verifyOnly || *onSuccess != "" {
+			fmt.Println("Sampled rollups cannot be verified, so verify, verifyonly and onsuccess cannot be used with sample")
+			return 1
+		}
+		if *sampleField != "" && !fieldRolledUp(*sampleField) {
+			fmt.Println("Sample field (samplefield) must be one of the fields being rolled up")
+			return 1
+		}
+	}
+	switch *splitBy {
+	case "", splitShards, splitTime:
+	default:
+		fmt.Println("Split (split) must be shards or time")
+		return 1
+	}
+	if *splitBy == splitTime && (*splitParts < 2 || *splitField == "") {
+		fmt.Println("Splitting by time needs a split field (splitfield) and at least 2 parts (splitparts)")
+		return 1
+	}
+	if *splitBy != "" && summary != nil {
+		fmt.Println("Summaries (summarize) are built a whole index at a time, so split cannot be used with summarize")
+		return 1
+	}
+	switch *readOrder {
+	case orderName, orderLargest, orderDestination:
+	default:
+		fmt.Println("Order (order) must be name, largest or destination")
+		return 1
+	}
+	if err := parseAgeFilters(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if *resume && *stateFile == "" {
+		fmt.Println("State file (state) must be specified to resume")
+		return 1
+	}
+
+	//Pick up where we left off last time, if we have been asked to
+	var savedState rollupState
+	if *resume {
+		consoleOut("Loading state...")
+		savedState, err = loadState(*stateFile)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		consoleOut("Done\n")
+	}
 
 	consoleOut("Creating read client...")
 	inClient, err := elastic.NewSimpleClient(elastic.SetURL(*inputHost)) //Simple client for scrolling through read data
@@ -80,88 +265,231 @@ func doMain() int {
 
 	consoleOut("Creating write client...")
 	var outClient *elastic.Client
-	outClient, err = elastic.NewSimpleClient(elastic.SetURL(*outputHost)) //This client is used for the bulk processor
+	outClient, err = elastic.NewSimpleClient(elastic.SetURL(outHost)) //This client is used for the bulk processor
 	if err != nil {
 		fmt.Println(err)
 		return 1
 	}
 	consoleOut("Done\n")
 
-	consoleOut("Creating bulk inserter...")
-	bulkInserter, err := outClient.BulkProcessor(). //This is our bulk processing service which will just accept docs and do the rest on its own
-							Name("RollupInserter").   //Random name for the processor
-							Workers(2).               //Number of processor workers. Haven't played around with this to see if it makes any difference
-							BulkActions(*bufferSize). //Buffer x records as specified by command flags
-							Stats(true).              //Collect stats
-							Do()                      //Go
+	//Find the indexes we need to roll up, based on the regex supplied on the command line
+	consoleOut("Matching indexes...")
+	matchingIndexes, unparsedIndexes, err := getElasticIndexes(inClient, inputPatternRegex)
 	if err != nil {
 		fmt.Println(err)
 		return 1
 	}
+	filterByDate(matchingIndexes)
 	consoleOut("Done\n")
+	if len(unparsedIndexes) > 0 && !*plan { //The plan lists them itself
+		sort.Strings(unparsedIndexes)
+		consoleOut("Warning: these indexes match infilter, but their dates could not be parsed with inpattern, so they will be skipped:\n")
+		for _, idx := range unparsedIndexes {
+			consoleOut("  %s\n", idx)
+		}
+	}
 
-	//Find the indexes we need to roll up, based on the regex supplied on the command line
-	consoleOut("Matching indexes...")
-	matchingIndexes, err := getElasticIndexes(inClient, inputPatternRegex)
-	if err != nil {
-		fmt.Println(err)
-		return 1
+	if *timeField != "" {
+		consoleOut("Finding document times...")
+		timeDestinations, untimedDocs, err = findTimeDestinations(inClient, matchingIndexes)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		filterByDate(matchingIndexes) //Indexes without a date in their name have one now
+		consoleOut("Done\n")
+
+		var untimed []string
+		for idx := range untimedDocs {
+			if _, ok := matchingIndexes[idx]; ok {
+				untimed = append(untimed, idx)
+			}
+		}
+		if len(untimed) > 0 {
+			sort.Strings(untimed)
+			consoleOut("These indexes have documents without the time field (timefield). They will not be rolled up, and the indexes will not pass verification or be retired:\n")
+			for _, idx := range untimed {
+				consoleOut("  %s: %d documents\n", idx, untimedDocs[idx])
+			}
+		}
 	}
+
+	if !*includeOpen {
+		if skipped := skipOpenDestinations(matchingIndexes); len(skipped) > 0 {
+			sort.Strings(skipped)
+			consoleOut("Skipping these indexes, as their destinations are still open (use includeopen to roll them up anyway):\n")
+			for _, idx := range skipped {
+				consoleOut("  %s\n", idx)
+			}
+		}
+	}
+
 	var matchingIndexesSorted []string
 	for k := range matchingIndexes {
 		matchingIndexesSorted = append(matchingIndexesSorted, k)
 	}
 	sort.Strings(matchingIndexesSorted)
+
+	//If all we are doing is showing what would happen, we can stop here
+	if *plan {
+		return doPlan(inClient, outClient, matchingIndexes, unparsedIndexes)
+	}
+
+	//If all we are doing is verifying a previous rollup, we can stop here
+	if *verifyOnly {
+		return doVerify(inClient, outClient, matchingIndexes)
+	}
+
+	//Make sure the source indexes agree on their mappings before we move any data
+	consoleOut("Checking mappings...")
+	destinations := groupByDestination(matchingIndexes)
+	sourceMappings, err := getSourceMappings(inClient, destinations)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	projectSourceMappings(sourceMappings) //We don't care about fields we aren't rolling up
+	conflicts := findMappingConflicts(destinations, sourceMappings, defaultResolution, fieldResolutions)
+	consoleOut("Done\n")
+	if len(conflicts) > 0 {
+		printConflictTable(conflicts)
+		for _, conflict := range conflicts {
+			if conflict.Resolution.Action == conflictFail {
+				fmt.Println("Source indexes have conflicting mappings. Use onconflict or fieldconflicts to choose how to resolve them")
+				return 1
+			}
+		}
+	}
+	fieldFixes = fieldFixesBySource(conflicts)
+
+	if *createIndexes {
+		consoleOut("Creating destination indexes...")
+		err = createDestinationIndexes(inClient, outClient, destinations, sourceMappings, conflicts)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		consoleOut("Done\n")
+	}
+
+	if *deadLetters != "" {
+		consoleOut("Opening dead letter file...")
+		deadLetter, err := openDeadLetter(*deadLetters)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer closeDeadLetter(deadLetter)
+		consoleOut("Done\n")
+	}
+
+	consoleOut("Creating bulk inserter...")
+	bulkInserter, err := newBulkInserter(outClient)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
 	consoleOut("Done\n")
 
 	consoleOut("Setting up readers...")
 	var allRead bool //This bool controls whether we keep our channels open and keep waiting for data
 	foundDocs := make(chan insertDoc)
-	for i, inIdxName := range matchingIndexesSorted {
-		var outIdxName string
-		if strings.Contains(*outputPattern, "ISOWEEK") {
-			year, week := matchingIndexes[inIdxName].ISOWeek()
-			isoWeek := fmt.Sprintf("%v-%v", year, week)
-			outIdxName = strings.Replace(*outputPattern, "ISOWEEK", isoWeek, 1)
-		} else {
-			outIdxName = matchingIndexes[inIdxName].Format(*outputPattern)
+	var tasks []rollupTask
+	for _, inIdxName := range matchingIndexesSorted {
+		outIdxName := strings.Join(destinationsOf(inIdxName, matchingIndexes[inIdxName]), ",")
+
+		//If we are resuming, then completed indexes are left alone and in-progress indexes are seeded
+		//with where they got up to. If the destination has changed since the state was saved, we can't
+		//trust the saved progress, so we start that index again.
+		if saved, ok := savedState[inIdxName]; ok && saved.DestinationIndex == outIdxName {
+			if saved.Done || saved.LastSort != nil || len(saved.Parts) > 0 {
+				readMutex.Lock()
+				readDocs[inIdxName] = saved
+				readMutex.Unlock()
+			}
+			if saved.Done && saved.Error == "" {
+				continue
+			}
 		}
 
-		//todo (mhenderson): This probably doesn't need to be channeled, because we are just throwing data
-		//                   into our bulk processing service. Originally this was a bit more complicated,
-		//                   which is why the channels are here. And they just sort of got left over.
-		go rollupIndex(i+1, foundDocs, inClient, outClient, inIdxName, outIdxName)
+		tasks = append(tasks, rollupTask{SourceIndex: inIdxName, DestinationIndex: outIdxName})
+	}
+	if err := orderTasks(inClient, tasks); err != nil {
+		closeBulkInserter(bulkInserter) //Otherwise its workers are left running, which matters when running jobs
+		fmt.Println(err)
+		return 1
+	}
+
+	//todo (mhenderson): This probably doesn't need to be channeled, because we are just throwing data
+	//                   into our bulk processing service. Originally this was a bit more complicated,
+	//                   which is why the channels are here. And they just sort of got left over.
+	ctx := runContext
+	workers := startWorkerPool(ctx, *threads, tasks, func(task rollupTask) {
+		rollupIndex(ctx, foundDocs, inClient, outClient, task.SourceIndex, task.DestinationIndex)
+	})
+	if *adaptive {
+		stopAdaptive := startAdaptive(ctx, inClient, outClient)
+		defer stopAdaptive()
 	}
 	consoleOut("Done\n")
 
 	next := time.After(delay)
 	got := 0
+	sinceFlush := 0
 	start := time.Now()
+	lastCheckpoint := start
 
 	for !allRead {
 		select {
 		case <-next:
 			allRead = printProgressTable(start, got, matchingIndexesSorted, bulkInserter)
+			if workers.Stopped() { //We have been asked to stop, and every reader has handed over what it read
+				allRead = true
+			}
+			if *stateFile != "" && time.Since(lastCheckpoint) >= checkpointDelay {
+				//Everything the readers have recorded as read has already been handed to the bulk inserter,
+				//so once it has been flushed it is safe to write out as our checkpoint. Unless a whole bulk
+				//request failed, in which case its documents are in neither the destination nor the dead
+				//letter file yet, and we leave the checkpoint until next time.
+				flushWithRetries(bulkInserter)
+				if !unsentWaiting() {
+					if err := saveState(*stateFile); err != nil {
+						consoleOut("Could not save state: %v\n", err)
+					}
+					lastCheckpoint = time.Now()
+				}
+			}
 			next = time.After(delay)
 		case r := <-foundDocs:
 			//See previous todo, this channel probably doesn't need to exist
 			got++
-			p := elastic.NewBulkIndexRequest(). //Index the document
-								Index(r.DestinationIndex). //Destination index
-								Type(r.Doc.Type).          //Document type
-								Id(r.Doc.Id).              //Document ID to prevent doubleups
-								Doc(r.Doc.Source)          //Original JSON document
-			bulkInserter.Add(p)
+			bulkInserter.Add(newRollupIndexRequest(r.SourceIndex, r.DestinationIndex, r.Doc.Type, r.Doc.Id, r.Doc.Source))
+			sinceFlush++
+			if limit := currentBulkLimit(); limit < *bufferSize && sinceFlush >= limit {
+				//adaptive wants smaller bulk requests than the bulk inserter was set up with
+				bulkInserter.Flush()
+				sinceFlush = 0
+			}
 		}
 	}
 
+	stopWorkerPool() //Every index has been read or we are stopping, so there is nothing left for it to do
+
 	//Print the final debug statements
 	consoleOut("Flushing final records...")
-	bulkInserter.Flush()
+	flushWithRetries(bulkInserter)
 	consoleOut("Done\n")
 	consoleOut("Closing inserter...")
-	bulkInserter.Close()
+	closeBulkInserter(bulkInserter)
 	consoleOut("Done\n")
+	if *stateFile != "" {
+		consoleOut("Saving state...")
+		if err := saveState(*stateFile); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		consoleOut("Done\n")
+	}
 
 	//Show the final stats
 	stats := bulkInserter.Stats()
@@ -173,75 +501,280 @@ func doMain() int {
 	consoleOut("Number of requests reported as success: %d\n", stats.Succeeded)
 	consoleOut("Number of requests reported as failed : %d\n", stats.Failed)
 	consoleOut("Total time elapsed: %v\n", time.Since(start))
+	printDeadLetterSummary()
+
+	if ctx.Err() != nil {
+		fmt.Println("Stopped before every source index was read")
+		if *stateFile != "" {
+			fmt.Printf("Run again with -resume to carry on from %s\n", *stateFile)
+		}
+	}
+
+	//If we couldn't read all of an index then there is no point verifying anything, and we certainly
+	//don't want to go retiring source indexes
+	var failedIndexes []string
+	for _, idx := range matchingIndexesSorted {
+		if readDocs[idx].Error != "" {
+			failedIndexes = append(failedIndexes, idx)
+		}
+	}
+	if len(failedIndexes) > 0 {
+		fmt.Printf("%d source indexes could not be read:\n", len(failedIndexes))
+		for _, idx := range failedIndexes {
+			fmt.Printf("  %s: %s\n", idx, readDocs[idx].Error)
+		}
+		return 1
+	}
+	if ctx.Err() != nil { //Nothing can be verified or retired until every index has been read
+		return 1
+	}
+	if skippedCount > 0 { //These documents are in the dead letter file (if there is one), not the destinations
+		fmt.Printf("%d documents could not be routed, transformed or summarized\n", skippedCount)
+		return 1
+	}
+	if unsentCount > 0 { //The destinations are missing documents, so there is nothing to verify
+		fmt.Printf("%d documents could not be sent to %s\n", unsentCount, outHost)
+		return 1
+	}
+	if failed := stats.Failed - int64(retriedCount); failed > 0 { //Rejected documents that were sent again are counted as failed too
+		fmt.Printf("%d documents failed to index into %s\n", failed, outHost)
+		return 1
+	}
+
+	if *verify || *onSuccess != "" {
+		return doVerify(inClient, outClient, matchingIndexes)
+	}
 
 	return 0
 }
 
-func getElasticIndexes(client *elastic.Client, indexRegex *regexp.Regexp) (elasticDailyIndexes, error) {
+//The host to write to. This defaults to the input host if it isn't specified. The flag itself is left alone,
+//as each job sets it again.
+func outputHostOrDefault() string {
+	if *outputHost == "" {
+		return *inputHost
+	}
+	return *outputHost
+}
+
+//Create the bulk processor that all our documents are sent through
+func newBulkInserter(outClient *elastic.Client) (*elastic.BulkProcessor, error) {
+	bulkInserter, err := outClient.BulkProcessor(). //This is our bulk processing service which will just accept docs and do the rest on its own
+							Name("RollupInserter").   //Random name for the processor
+							Workers(2).               //Number of processor workers. Haven't played around with this to see if it makes any difference
+							BulkActions(*bufferSize). //Buffer x records as specified by command flags
+							Stats(true).              //Collect stats
+							After(bulkAfter).         //Keep track of the documents that failed
+							Do()                      //Go
+
+	//Documents rejected by a busy cluster are sent through the same inserter again
+	retryMutex.Lock()
+	retryInserter = bulkInserter
+	retriedCount = 0
+	retryMutex.Unlock()
+	return bulkInserter, err
+}
+
+//Group the source indexes by the name of the destination index they get rolled up into
+func groupByDestination(matchingIndexes elasticDailyIndexes) map[string][]string {
+	destinations := make(map[string][]string)
+	for idx, indexDate := range matchingIndexes {
+		for _, outIdxName := range destinationsOf(idx, indexDate) {
+			destinations[outIdxName] = append(destinations[outIdxName], idx)
+		}
+	}
+	return destinations
+}
+
+//Work out the name of the index that a source index with the given date gets rolled up into
+func destinationIndexName(idx string, indexDate time.Time) string {
+	if outputTemplate != nil {
+		return executeOutputTemplate(idx, indexDate)
+	}
+
+	//Capture groups are put in after the date is formatted, so that they can't be mistaken for part of the layout
+	groups := inputCaptures(idx)
+	name := ""
+	last := 0
+	for _, loc := range captureReference.FindAllStringIndex(*outputPattern, -1) {
+		name += formatDateLayout((*outputPattern)[last:loc[0]], indexDate)
+		name += expandCaptures((*outputPattern)[loc[0]:loc[1]], groups)
+		last = loc[1]
+	}
+	return name + formatDateLayout((*outputPattern)[last:], indexDate)
+}
+
+//Format a date with a Go time layout, which can also contain ISOWEEK
+func formatDateLayout(layout string, indexDate time.Time) string {
+	if strings.Contains(layout, "ISOWEEK") {
+		year, week := indexDate.ISOWeek()
+		isoWeek := fmt.Sprintf("%v-%v", year, week)
+		return strings.Replace(layout, "ISOWEEK", isoWeek, 1)
+	}
+	return indexDate.Format(layout)
+}
+
+//Returns the indexes that match the regex along with the date parsed from their names, and separately
+//the names of any indexes that matched the regex but whose date couldn't be parsed. When routing by the
+//time field we don't need a date from the name, so those indexes are returned with a zero date instead.
+func getElasticIndexes(client *elastic.Client, indexRegex *regexp.Regexp) (elasticDailyIndexes, []string, error) {
 	filteredIndexes := make(elasticDailyIndexes) //make our map of filtered indexes
-	allIndexes, err := client.IndexNames()       //fetch all indexes from elastic server
+	var unparsedIndexes []string
+	allIndexes, err := client.IndexNames() //fetch all indexes from elastic server
 	if err != nil {
-		return filteredIndexes, err //At this stage, filteredIndexes is empty so we can return it with the error
+		return filteredIndexes, unparsedIndexes, err //At this stage, filteredIndexes is empty so we can return it with the error
 	}
 	for _, idx := range allIndexes { //We need to filter our indexes to only those that match the pattern provided
 		if indexRegex.MatchString(idx) { //If we have a matching pattern
-			thisIndexDate, err := time.Parse(*inputPattern, idx) //Decode the date
+			thisIndexDate, err := time.Parse(*inputPattern, indexDateText(indexRegex, idx)) //Decode the date
 			if err == nil {
 				filteredIndexes[idx] = thisIndexDate //Add this pattern to our map
+			} else if *timeField != "" {
+				filteredIndexes[idx] = time.Time{}
+			} else {
+				unparsedIndexes = append(unparsedIndexes, idx)
 			}
 		}
 	}
-	return filteredIndexes, nil //Return all the matched patterns
+	return filteredIndexes, unparsedIndexes, nil //Return all the matched patterns
 }
 
-//This is our really basic thread scheduling function. It checks two things:
-// - Are we at our limit of threads to be running?
-// - Was the last thread to be run the one before this one?
-//It's simple and not the best, but it's good enough for this one off task.
-func okToStart(threadNo int) bool {
-	runningMutex.Lock()
-	freeThreads := runningThreads < *threads //Are we at our limit of threads?
-	myTurn := lastThread == threadNo-1       //Was the last thread run the one before this thread?
-	ok := freeThreads && myTurn
-	if ok { //If all checks out OK, then increase the running thread counter and set the last thread to this one
-		runningThreads++
-		lastThread = threadNo
-	}
-	runningMutex.Unlock()
-	return ok
-}
-
-func rollupIndex(threadNo int, c chan<- insertDoc, inClient, outClient *elastic.Client, inIndex, outIndex string) error {
-	countUpdate := 100
-	i := 0
-
-	for !okToStart(threadNo) {
-		time.Sleep(100 * time.Millisecond)
+//The part of an index name that holds its date. This is the date capture group of the regex if it has
+//one, otherwise the whole name.
+func indexDateText(indexRegex *regexp.Regexp, idx string) string {
+	match := indexRegex.FindStringSubmatch(idx)
+	for i, name := range indexRegex.SubexpNames() {
+		if name == "date" && match != nil {
+			return match[i]
+		}
 	}
+	return idx
+}
 
+//Read a single source index into its destination. This is run by the workers of the worker pool. If ctx
+//is cancelled we stop reading, and the index is left as it would be part way through so that it can be
+//resumed.
+func rollupIndex(ctx context.Context, c chan<- insertDoc, inClient, outClient *elastic.Client, inIndex, outIndex string) {
+	//If we are resuming this index there will already be a stat for it with the last place we got to
 	readMutex.Lock()
-	readDocs[inIndex] = rollupStat{
-		DestinationIndex: outIndex,
-		ReadCount:        0,
-		Done:             false,
+	docStat := readDocs[inIndex]
+	docStat.DestinationIndex = outIndex
+	docStat.Done = false
+	docStat.Error = ""
+	if docStat.Split != splitDescription() { //Progress from a different split doesn't tell us where to start
+		docStat.Split = ""
+		docStat.Parts = nil
+		docStat.ReadCount = 0
+		docStat.LastSort = nil
 	}
+	readDocs[inIndex] = docStat
 	readMutex.Unlock()
+	i := docStat.ReadCount
+	lastSort := docStat.LastSort
+	var acc summaryAccumulator
+	if summary != nil { //Summaries are only written once the whole index is read, so we always start from the top
+		i = 0
+		lastSort = nil
+	}
 
+	var err error
 	defer func() {
-		runningMutex.Lock()
-		runningThreads--
-		runningMutex.Unlock()
 		readMutex.Lock()
 		docStat := readDocs[inIndex]
 		docStat.Done = true
 		docStat.ReadCount = i
+		docStat.Error = ""
+		if ctx.Err() != nil { //We were stopped rather than failing, so remember exactly where we got to
+			docStat.Done = false
+			docStat.LastSort = lastSort
+		} else if err != nil {
+			docStat.Error = err.Error()
+		}
 		readDocs[inIndex] = docStat
 		readMutex.Unlock()
 	}()
 
+	if *splitBy != "" {
+		i, err = rollupParts(ctx, c, inClient, inIndex, outIndex)
+		return
+	}
+
+	//If the scroll fails part way through (e.g. it times out) we try again, backing off a bit more each
+	//time. If we are keeping state we know where we got up to, otherwise we have to start from the top.
+	startCount := i
+	attempt := func() error {
+		if lastSort == nil {
+			i = startCount
+		}
+		if summary != nil {
+			i = 0
+			lastSort = nil
+			acc = make(summaryAccumulator)
+		}
+		return scrollIndex(ctx, c, inClient, inIndex, outIndex, rollupPart{}, &i, &lastSort, acc, func(count int, sort interface{}) {
+			readMutex.Lock()
+			docStat := readDocs[inIndex]
+			docStat.ReadCount = count
+			docStat.LastSort = sort
+			readDocs[inIndex] = docStat
+			readMutex.Unlock()
+		})
+	}
+	retryNotify := func(err error, wait time.Duration) {
+		readMutex.Lock()
+		docStat := readDocs[inIndex]
+		docStat.Error = err.Error()
+		docStat.Retries++
+		readDocs[inIndex] = docStat
+		readMutex.Unlock()
+	}
+	policy := backoff.NewExponentialBackoff(time.Second, 2*time.Minute).SendStop(true)
+	err = retryContext(ctx, attempt, policy, retryNotify)
+
+	if err == nil && acc != nil {
+		var hits []*elastic.SearchHit
+		if hits, err = acc.documents(inIndex, outIndex); err != nil {
+			return
+		}
+		for _, hit := range hits {
+			if err = throttle(ctx, hit.Source); err != nil {
+				return
+			}
+			c <- insertDoc{
+				SourceIndex:      inIndex,
+				DestinationIndex: hit.Index,
+				Doc:              hit,
+			}
+		}
+	}
+}
+
+//Read every document in an index, or in one part of it, and send it off to be indexed into the destination.
+//i is the number of documents read so far and lastSort is the sort value of the last document read, which
+//are both kept up to date as we go so that if we fail we know where we got to, and are passed to progress
+//every so often. If acc is given, the documents are added to it instead of being sent. The scroll is
+//cleared when we are done with it, even if we stopped part way.
+func scrollIndex(ctx context.Context, c chan<- insertDoc, inClient *elastic.Client, inIndex, outIndex string, part rollupPart, i *int, lastSort *interface{}, acc summaryAccumulator, progress func(int, interface{})) error {
+	countUpdate := 100
+	rates := make(map[string]int) //Sample rate of each destination we have sent documents to
+
 	scroll := inClient.Scroll(inIndex).Size(*bufferSize)
+	if *stateFile != "" {
+		//We need a stable order so that we can tell where we got up to
+		scroll = scroll.Sort(stateSortField, true)
+	}
+	if part.Preference != "" {
+		scroll = scroll.Preference(part.Preference)
+	}
+	if query := partQuery(sourceQuery(*lastSort), part); query != nil {
+		scroll = scroll.Query(query)
+	}
+	if filter := sourceFilter(); filter != nil {
+		scroll = scroll.FetchSourceContext(filter)
+	}
+	defer scroll.Clear(context.Background()) //ctx may already be cancelled, and we still want this to happen
 	for {
-		results, err := scroll.Do()
+		results, err := scroll.DoC(ctx)
 		if err == io.EOF {
 			return nil
 		}
@@ -249,18 +782,19 @@ func rollupIndex(threadNo int, c chan<- insertDoc, inClient, outClient *elastic.
 			return err
 		}
 		for _, doc := range results.Hits.Hits {
-			i++
-			c <- insertDoc{
-				DestinationIndex: outIndex,
-				Doc:              doc,
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err := sendDocument(ctx, c, inIndex, outIndex, doc, acc, rates); err != nil {
+				return err
+			}
+			*i++
+			if len(doc.Sort) > 0 {
+				*lastSort = doc.Sort[0]
 			}
 
-			if i%countUpdate == 0 {
-				readMutex.Lock()
-				docStat := readDocs[inIndex]
-				docStat.ReadCount += countUpdate
-				readDocs[inIndex] = docStat
-				readMutex.Unlock()
+			if *i%countUpdate == 0 {
+				progress(*i, *lastSort)
 			}
 		}
 	}
@@ -268,9 +802,79 @@ func rollupIndex(threadNo int, c chan<- insertDoc, inClient, outClient *elastic.
 
 func main() {
 	flag.Parse()
+	runContext = notifyShutdown()
+	if *controlAddr != "" {
+		startControlServer(*controlAddr)
+	}
+	if *configFile != "" {
+		os.Exit(doJobs())
+	}
+	if *jobNames != "" {
+		fmt.Println("Jobs (job) can only be picked from a config file (config)")
+		os.Exit(1)
+	}
+	os.Exit(runOnce())
+}
+
+//Run whatever the options ask for, and return the exit code
+func runOnce() int {
+	if err := startThrottle(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
 	if *benchmark {
 		runBenchmark()
-	} else {
-		os.Exit(doMain()) //Exit with the proper code, but this maintains the defers that you don't get running in main()
+		return 0
+	} else if *replayFile != "" {
+		return doReplay()
+	}
+	return doMain() //Exit with the proper code, but this maintains the defers that you don't get running in main()
+}
+
+//Send a document to be indexed, or add it to the summaries. This is where the document is routed by its
+//time field, sampled, transformed and throttled. Documents we can't do that to are set aside in the dead
+//letter file. The only error is ctx being cancelled while we wait for the throttle, in which case the
+//document hasn't been sent.
+func sendDocument(ctx context.Context, c chan<- insertDoc, inIndex, outIndex string, doc *elastic.SearchHit, acc summaryAccumulator, rates map[string]int) error {
+	if *timeField != "" && acc == nil { //Summaries are routed by their bucket time instead
+		docIndex, err := routeDocument(inIndex, doc.Source)
+		if err != nil {
+			//outIndex is every destination of the source index, and we don't know which one this belongs in
+			skipDocument(inIndex, "", doc.Type, doc.Id, doc.Source, "route_error", err)
+			return nil
+		}
+		outIndex = docIndex
+	}
+
+	rate, ok := rates[outIndex]
+	if !ok {
+		rate = sampleRate(outIndex)
+		rates[outIndex] = rate
+	}
+	if !keepSample(doc, rate) { //Documents that aren't in the sample are read but go no further
+		return nil
+	}
+
+	//Sort out any fields whose mappings conflict with other source indexes, and run the transforms
+	source, err := processDocument(inIndex, doc.Source, rate)
+	if err != nil {
+		skipDocument(inIndex, outIndex, doc.Type, doc.Id, doc.Source, "transform_error", err)
+		return nil
+	}
+	if acc != nil { //Summaries are throttled when they are sent, rather than the documents that go into them
+		if err := acc.add(source); err != nil {
+			skipDocument(inIndex, outIndex, doc.Type, doc.Id, doc.Source, "summary_error", err)
+		}
+		return nil
+	}
+	if err := throttle(ctx, source); err != nil {
+		return err
+	}
+	doc.Source = source
+	c <- insertDoc{
+		SourceIndex:      inIndex,
+		DestinationIndex: outIndex,
+		Doc:              doc,
 	}
+	return nil
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+//These settings are generated by ElasticSearch when an index is created, and it will refuse
+//to create an index that has them set
+var generatedSettings = []string{
+	"index.creation_date",
+	"index.uuid",
+	"index.version.created",
+	"index.version.upgraded",
+	"index.provided_name",
+}
+
+//The most index names we put in a single request. A destination can have hundreds of source indexes,
+//and ElasticSearch refuses URLs longer than 4KB by default.
+const indexChunkSize = 100
+
+//Split a list of indexes into chunks of at most indexChunkSize, keeping them in the same order
+func indexChunks(indexes []string) [][]string {
+	var chunks [][]string
+	for start := 0; start < len(indexes); start += indexChunkSize {
+		end := start + indexChunkSize
+		if end > len(indexes) {
+			end = len(indexes)
+		}
+		chunks = append(chunks, indexes[start:end])
+	}
+	return chunks
+}
+
+//Settings that belong to the source indexes where they are, and would break the destination if they were
+//copied. Blocks (e.g. a source that was made read only before the rollup) would stop us writing to it,
+//and allocation rules can name nodes that don't exist on the output cluster.
+var sourceOnlySettingPrefixes = []string{
+	"index.blocks.",
+	"index.routing.allocation.",
+}
+
+//Create each of our destination indexes up front, using the mappings and settings of the source
+//indexes that feed into it. If we leave it to ElasticSearch to create the index on the first bulk
+//insert then we get dynamic mappings and default settings, which isn't what anyone wants.
+func createDestinationIndexes(inClient, outClient *elastic.Client, destinations map[string][]string, sourceMappings map[string]map[string]interface{}, conflicts []fieldConflict) error {
+	var destinationsSorted []string
+	for outIdxName := range destinations {
+		destinationsSorted = append(destinationsSorted, outIdxName)
+	}
+	sort.Strings(destinationsSorted)
+
+	for _, outIdxName := range destinationsSorted {
+		exists, err := outClient.IndexExists(outIdxName).Do()
+		if err != nil {
+			return fmt.Errorf("could not check %s exists: %v", outIdxName, err)
+		}
+		if exists { //Most likely we are resuming or topping up a previous rollup, so leave it alone
+			continue
+		}
+
+		sources := destinations[outIdxName]
+		mappings := mergedMappings(sources, sourceMappings)
+		var destinationConflicts []fieldConflict
+		for _, conflict := range conflicts {
+			if conflict.DestinationIndex == outIdxName {
+				destinationConflicts = append(destinationConflicts, conflict)
+			}
+		}
+		resolveMappingConflicts(mappings, destinationConflicts)
+		if summary != nil {
+			mappings = summary.mappings(mappings)
+		}
+		if sampleRate(outIdxName) > 1 {
+			addSampleRateMapping(mappings)
+		}
+		settings, err := mergedSettings(inClient, sources)
+		if err != nil {
+			return err
+		}
+
+		body := map[string]interface{}{
+			"settings": settings,
+			"mappings": mappings,
+		}
+		if _, err := outClient.CreateIndex(outIdxName).BodyJson(body).Do(); err != nil {
+			return fmt.Errorf("could not create %s: %v", outIdxName, err)
+		}
+	}
+	return nil
+}
+
+//Fetch the mappings of every source index, keyed by index name and then document type. We ask for
+//them a chunk of each destination's sources at a time so that we don't end up with an enormous URL.
+func getSourceMappings(client *elastic.Client, destinations map[string][]string) (map[string]map[string]interface{}, error) {
+	sourceMappings := make(map[string]map[string]interface{})
+	for _, sources := range destinations {
+		for _, chunk := range indexChunks(sources) {
+			response, err := client.GetMapping().Index(chunk...).Do()
+			if err != nil {
+				return sourceMappings, fmt.Errorf("could not get mappings: %v", err)
+			}
+			for _, idx := range chunk {
+				indexMapping, _ := response[idx].(map[string]interface{})
+				typeMappings, _ := indexMapping["mappings"].(map[string]interface{})
+				sourceMappings[idx] = typeMappings
+			}
+		}
+	}
+	return sourceMappings, nil
+}
+
+//Merge the mappings of the given source indexes together into one set of mappings, keyed by
+//document type. Sources are merged in name order, so if the indexes disagree about a field then
+//the newest index wins.
+func mergedMappings(sources []string, sourceMappings map[string]map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{})
+	sorted := append([]string{}, sources...)
+	sort.Strings(sorted)
+	for _, idx := range sorted {
+		mergeMaps(merged, sourceMappings[idx])
+	}
+	return merged
+}
+
+//Fetch the settings of all the given indexes and merge them together, leaving out the ones that
+//ElasticSearch generates for itself and the ones that only make sense on the source indexes. The
+//shard and replica counts can be overridden from the command line.
+func mergedSettings(client *elastic.Client, sources []string) (map[string]interface{}, error) {
+	merged := make(map[string]interface{})
+	sorted := append([]string{}, sources...)
+	sort.Strings(sorted)
+	for _, chunk := range indexChunks(sorted) { //Chunks are taken in name order, so the newest index still wins
+		response, err := client.IndexGetSettings(chunk...).FlatSettings(true).Do()
+		if err != nil {
+			return merged, fmt.Errorf("could not get settings: %v", err)
+		}
+		for _, idx := range chunk {
+			if response[idx] == nil {
+				continue
+			}
+			for k, v := range response[idx].Settings {
+				merged[k] = v
+			}
+		}
+	}
+	for _, k := range generatedSettings {
+		delete(merged, k)
+	}
+	for k := range merged {
+		for _, prefix := range sourceOnlySettingPrefixes {
+			if strings.HasPrefix(k, prefix) {
+				delete(merged, k)
+			}
+		}
+	}
+
+	if *shards > 0 {
+		merged["index.number_of_shards"] = *shards
+	}
+	if *replicas >= 0 {
+		merged["index.number_of_replicas"] = *replicas
+	}
+	return merged, nil
+}
+
+//Recursively merge src into dst. Where both have a value for the same key and they aren't both
+//maps, the value from src wins.
+func mergeMaps(dst, src map[string]interface{}) {
+	for k, srcValue := range src {
+		srcMap, srcIsMap := srcValue.(map[string]interface{})
+		dstMap, dstIsMap := dst[k].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			mergeMaps(dstMap, srcMap)
+			continue
+		}
+		if srcIsMap { //Copy maps rather than sharing them, otherwise later merges would modify our source
+			dstMap = make(map[string]interface{})
+			mergeMaps(dstMap, srcMap)
+			dst[k] = dstMap
+			continue
+		}
+		dst[k] = srcValue
+	}
+}
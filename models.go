@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 
 	elastic "gopkg.in/olivere/elastic.v3"
@@ -8,6 +9,7 @@ import (
 
 type elasticDailyIndexes map[string]time.Time
 type insertDoc struct {
+	SourceIndex      string
 	DestinationIndex string
 	Doc              *elastic.SearchHit
 }
@@ -16,6 +18,214 @@ type rollupStat struct {
 	DestinationIndex string
 	ReadCount        int
 	Done             bool
+	LastSort         interface{}  `json:",omitempty"` //Sort value of the last document read, used to resume a scroll
+	Error            string       `json:",omitempty"` //The last error reading this index. If it is Done with an error, it failed
+	Retries          int          `json:",omitempty"`
+	Split            string       `json:",omitempty"` //How the index was split into parts, blank if it wasn't
+	Parts            []rollupPart `json:",omitempty"`
+}
+
+//One of the parts a source index is split into by the split option, which are all read at the same time
+type rollupPart struct {
+	Preference string     `json:",omitempty"` //The shard to read, as a search preference
+	From       *time.Time `json:",omitempty"` //Start of the time range to read. If nil, everything before To, including documents without the field
+	To         *time.Time `json:",omitempty"` //End of the time range to read, exclusive. If nil, everything from From
+	ReadCount  int
+	Done       bool
+	LastSort   interface{} `json:",omitempty"`
+	Error      string      `json:",omitempty"`
+	Retries    int         `json:",omitempty"`
+}
+
+//rollupState is what gets written to the -state file. It is keyed by source index name.
+type rollupState map[string]rollupStat
+
+type verifyResult struct {
+	DestinationIndex string
+	SourceIndexes    []string
+	Expected         int64 //Total documents in the source indexes
+	Actual           int64 //Documents in the destination index
+}
+type verifyResults []verifyResult
+
+func (r verifyResult) Delta() int64 {
+	return r.Actual - r.Expected
+}
+
+func (s verifyResults) Len() int {
+	return len(s)
+}
+func (s verifyResults) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s verifyResults) Less(i, j int) bool {
+	return s[i].DestinationIndex < s[j].DestinationIndex
+}
+
+//The values that can be used in an outpattern template
+type outputName struct {
+	Time    time.Time //The date of the source index, or of the document when routing by the time field
+	Index   string    //Name of the source index
+	Year    int
+	Month   int
+	Day     int
+	Hour    int
+	ISOYear int
+	ISOWeek int
+	Quarter int
+	Half    int
+	Groups  map[string]string //Capture groups from infilter, by number and name
+}
+
+//A single source index in the output of -plan
+type planEntry struct {
+	SourceIndex       string `json:"source_index"`
+	DestinationIndex  string `json:"destination_index,omitempty"`
+	Documents         int64  `json:"documents"`
+	StoreBytes        int64  `json:"store_bytes"`
+	DestinationExists bool   `json:"destination_exists"`
+	Unparsed          bool   `json:"unparsed,omitempty"` //Matched infilter but the date couldn't be parsed with inpattern
+}
+
+//A document that could not be indexed, as written to the dead letter file
+type deadLetter struct {
+	SourceIndex      string           `json:"source_index"`
+	DestinationIndex string           `json:"destination_index"`
+	Id               string           `json:"_id"`
+	Type             string           `json:"_type"`
+	ErrorType        string           `json:"error_type"`
+	ErrorReason      string           `json:"error_reason"`
+	Doc              *json.RawMessage `json:"doc"`
+	Transformed      bool             `json:"transformed,omitempty"` //Doc is what was sent to ElasticSearch, so it has already been through the transforms
+}
+
+//What adaptive saw when it last checked the thread pools of the clusters
+type clusterLoad struct {
+	BulkQueue   int   //Longest bulk queue of any node in the destination cluster
+	SearchQueue int   //Longest search queue of any node in the source cluster
+	Rejected    int64 //Bulk and search requests the thread pools have rejected since their nodes started
+}
+
+type conflictResolution struct {
+	Action string
+	Type   string //The type we are coercing to
+}
+
+func (r conflictResolution) String() string {
+	if r.Action == conflictCoerce {
+		return conflictCoerce + ":" + r.Type
+	}
+	return r.Action
+}
+
+//A field that has more than one type across the source indexes of a single destination
+type fieldConflict struct {
+	DestinationIndex string
+	Field            string
+	Types            map[string][]string    //Field type -> source indexes that have it mapped as that type
+	Mappings         map[string]interface{} //Field type -> the mapping of the field as that type
+	Resolution       conflictResolution
+}
+type fieldConflicts []fieldConflict
+
+func (s fieldConflicts) Len() int {
+	return len(s)
+}
+func (s fieldConflicts) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s fieldConflicts) Less(i, j int) bool {
+	if s[i].DestinationIndex == s[j].DestinationIndex {
+		return s[i].Field < s[j].Field
+	}
+	return s[i].DestinationIndex < s[j].DestinationIndex
+}
+
+//The changes we need to make to documents from a given source index as they are rolled up
+type fieldFix struct {
+	Field      string
+	SourceType string //How the field is mapped in the source index
+	Resolution conflictResolution
+}
+
+//A single step in the transforms file
+type transformStep struct {
+	Op    string      `json:"op"`
+	Field string      `json:"field"`           //Dotted path of the field to change, e.g. request.bytes
+	To    string      `json:"to,omitempty"`    //New name of the field, for rename
+	Value interface{} `json:"value,omitempty"` //Value to set the field to, for set
+	Type  string      `json:"type,omitempty"`  //Type to convert the field to, for convert
+}
+
+//The summary file, which describes how to build summary documents instead of copying documents
+type summarySpec struct {
+	TimestampField  string          `json:"timestamp_field"`
+	TimestampFormat string          `json:"timestamp_format,omitempty"` //Go time layout of the timestamps, if they aren't ISO8601 or epoch milliseconds
+	Interval        string          `json:"interval"`                   //Size of each time bucket, e.g. 5m
+	GroupBy         []string        `json:"group_by"`
+	Metrics         []summaryMetric `json:"metrics"`
+	Type            string          `json:"type,omitempty"` //Document type of the summary documents
+
+	interval time.Duration
+}
+
+type summaryMetric struct {
+	Field string `json:"field"`
+	Type  string `json:"type"`           //sum, min, max, avg, count or cardinality
+	Name  string `json:"name,omitempty"` //Field to write the metric to, field_type if not given
+}
+
+//A sample rate from the sample option, for the destination indexes that match Pattern
+type sampleRule struct {
+	Pattern string
+	Rate    int //Keep 1 in every Rate documents
+}
+
+//The config file of jobs given by the config option
+type jobConfig struct {
+	Threads  int               //The most threads any job can use
+	Defaults map[string]string //Options for every job
+	Jobs     []rollupJob
+}
+
+type rollupJob struct {
+	Name  string
+	Flags map[string]string //Option name -> value, as it would be given on the command line
+}
+
+type jobResult struct {
+	Name     string
+	ExitCode int
+	Elapsed  time.Duration
+}
+
+//A source index waiting to be read by the worker pool
+type rollupTask struct {
+	SourceIndex      string
+	DestinationIndex string
+	StoreBytes       int64 //Only filled in when ordering by size
+}
+type tasksBySize []rollupTask
+type tasksByDestination []rollupTask
+
+func (s tasksBySize) Len() int {
+	return len(s)
+}
+func (s tasksBySize) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s tasksBySize) Less(i, j int) bool {
+	return s[i].StoreBytes > s[j].StoreBytes
+}
+
+func (s tasksByDestination) Len() int {
+	return len(s)
+}
+func (s tasksByDestination) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s tasksByDestination) Less(i, j int) bool {
+	return s[i].DestinationIndex < s[j].DestinationIndex
 }
 
 type benchmarkData map[benchmarkSet]benchmarkResult
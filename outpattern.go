@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	outputTemplate   *template.Template                      //Parsed from outpattern when it is a template rather than a Go time layout
+	captureReference = regexp.MustCompile(`\$(\{\w+\}|\w+)`) //A reference to a capture group from infilter, e.g. ${family} or $1
+)
+
+//Functions that can be used in an outpattern template, on top of the ones built in to Go templates
+//such as printf
+var outputFuncs = template.FuncMap{
+	"pad": func(width, n int) string { //Zero pad a number, e.g. {{pad 2 .ISOWeek}}
+		return fmt.Sprintf("%0*d", width, n)
+	},
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"replace": func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+}
+
+//Parse outpattern if it is a template, which is anything containing {{. We try it out on the current
+//time so that mistakes like misspelt fields are found now, rather than halfway through the rollup.
+//Otherwise, any capture groups it refers to have to be in infilter. Templates use .Groups instead, as
+//$ means something else inside a template.
+func parseOutputPattern() error {
+	if !strings.Contains(*outputPattern, "{{") {
+		outputTemplate = nil
+		groups := inputCaptures("")
+		for _, ref := range captureReference.FindAllString(*outputPattern, -1) {
+			if _, ok := groups[captureName(ref)]; !ok {
+				return fmt.Errorf("infilter has no capture group %s", ref)
+			}
+		}
+		return nil
+	}
+	t, err := template.New("outpattern").Funcs(outputFuncs).Option("missingkey=error").Parse(*outputPattern)
+	if err != nil {
+		return err
+	}
+	if err := t.Execute(&bytes.Buffer{}, newOutputName("", time.Now())); err != nil {
+		return err
+	}
+	outputTemplate = t
+	return nil
+}
+
+//Build the values that an outpattern template can use for a source index and date
+func newOutputName(idx string, indexDate time.Time) outputName {
+	isoYear, isoWeek := indexDate.ISOWeek()
+	month := int(indexDate.Month())
+	return outputName{
+		Time:    indexDate,
+		Index:   idx,
+		Year:    indexDate.Year(),
+		Month:   month,
+		Day:     indexDate.Day(),
+		Hour:    indexDate.Hour(),
+		ISOYear: isoYear,
+		ISOWeek: isoWeek,
+		Quarter: (month-1)/3 + 1,
+		Half:    (month-1)/6 + 1,
+		Groups:  inputCaptures(idx),
+	}
+}
+
+//The capture groups of infilter for a source index, keyed by both number and name. If the index doesn't
+//match, every group is there but blank.
+func inputCaptures(idx string) map[string]string {
+	groups := make(map[string]string)
+	if inputRegex == nil {
+		return groups
+	}
+	match := inputRegex.FindStringSubmatch(idx)
+	for i, name := range inputRegex.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+		value := ""
+		if match != nil {
+			value = match[i]
+		}
+		groups[strconv.Itoa(i)] = value
+		if name != "" {
+			groups[name] = value
+		}
+	}
+	return groups
+}
+
+//Replace any references to capture groups in a string with their values
+func expandCaptures(s string, groups map[string]string) string {
+	return captureReference.ReplaceAllStringFunc(s, func(ref string) string {
+		return groups[captureName(ref)]
+	})
+}
+
+//The name or number of the capture group in a reference, e.g. family for ${family}
+func captureName(ref string) string {
+	return strings.Trim(ref, "${}")
+}
+
+//Work out a destination index name from the outpattern template
+func executeOutputTemplate(idx string, indexDate time.Time) string {
+	var name bytes.Buffer
+	if err := outputTemplate.Execute(&name, newOutputName(idx, indexDate)); err != nil {
+		//The template was tried out when it was parsed, so this should never happen, and if it does
+		//a name that can't be an index will make it obvious
+		return fmt.Sprintf("<%v>", err)
+	}
+	return name.String()
+}
@@ -6,6 +6,7 @@ import (
 	"os/exec"
 	"runtime"
 	"sort"
+	"strings"
 	"time"
 
 	elastic "gopkg.in/olivere/elastic.v3"
@@ -28,15 +29,28 @@ func printProgressTable(start time.Time, got int, matchingIndexesSorted []string
 	var anyNotDone bool
 
 	consoleOut("Elapsed: %v\n", time.Since(start))
+	workers, busy := 0, 0
+	if p := currentPool(); p != nil {
+		workers, busy = p.Size()
+	}
 	workerWord := "workers"
-	if runningThreads == 1 {
+	if workers == 1 {
 		workerWord = "worker"
 	}
 
 	perSec := float64(got) / time.Since(start).Seconds()
 
-	consoleOut("%v documents read by %v %s (avg %d/sec)\n", got, runningThreads, workerWord, int(perSec))
+	consoleOut("%v documents read by %v of %v %s (avg %d/sec)\n", got, busy, workers, workerWord, int(perSec))
 	consoleOut("%v documents committed to Elastic (%v failed)\n", inserterStats.Indexed, inserterStats.Failed)
+	if status := adaptiveDescription(); status != "" {
+		consoleOut("%s\n", status)
+	}
+	if throttled := throttleDescription(); throttled != "" {
+		consoleOut("%s\n", throttled)
+	}
+	if runContext.Err() != nil {
+		consoleOut("Stopping once the workers have finished, press Ctrl-C again to stop immediately\n")
+	}
 
 	table := tablewriter.NewWriter(os.Stdout)
 	tableHeader := []string{
@@ -44,11 +58,25 @@ func printProgressTable(start time.Time, got int, matchingIndexesSorted []string
 		"Source",
 		"Destination",
 		"Records",
+		"Error",
+	}
+	if *splitBy != "" {
+		tableHeader = append(tableHeader, "Parts")
 	}
 	table.SetHeader(tableHeader)
 
+	//Take a copy of the stats, as the readers are updating them (and the parts inside them) as we go
+	readMutex.Lock()
+	docStats := make(map[string]rollupStat, len(matchingIndexesSorted))
 	for _, idx := range matchingIndexesSorted {
 		thisStat := readDocs[idx]
+		thisStat.Parts = append([]rollupPart(nil), thisStat.Parts...)
+		docStats[idx] = thisStat
+	}
+	readMutex.Unlock()
+
+	for _, idx := range matchingIndexesSorted {
+		thisStat := docStats[idx]
 		if !thisStat.Done {
 			anyNotDone = true
 		}
@@ -57,15 +85,26 @@ func printProgressTable(start time.Time, got int, matchingIndexesSorted []string
 			status = "IN PROGRESS"
 
 		}
+		if thisStat.Error != "" {
+			status = fmt.Sprintf("RETRY %-5d", thisStat.Retries)
+		}
 		if thisStat.Done {
 			status = "COMPLETE   "
+			if thisStat.Error != "" {
+				status = "FAILED     "
+			}
 		}
-		table.Append([]string{
+		row := []string{
 			status,
 			idx,
 			thisStat.DestinationIndex,
 			fmt.Sprintf("%d", thisStat.ReadCount),
-		})
+			thisStat.Error,
+		}
+		if *splitBy != "" {
+			row = append(row, fmt.Sprintf("%d/%d", partsDone(thisStat.Parts), len(thisStat.Parts)))
+		}
+		table.Append(row)
 	}
 
 	if !silent {
@@ -75,6 +114,121 @@ func printProgressTable(start time.Time, got int, matchingIndexesSorted []string
 	return !anyNotDone
 }
 
+//Print a nice table to stdout comparing the source and destination document counts
+func printVerifyTable(results []verifyResult) {
+	table := tablewriter.NewWriter(os.Stdout)
+	tableHeader := []string{
+		"Status",
+		"Destination",
+		"Sources",
+		"Expected",
+		"Actual",
+		"Delta",
+	}
+	table.SetHeader(tableHeader)
+
+	for _, result := range results {
+		status := "OK      "
+		if result.Delta() != 0 {
+			status = "MISMATCH"
+		}
+		table.Append([]string{
+			status,
+			result.DestinationIndex,
+			fmt.Sprintf("%d", len(result.SourceIndexes)),
+			fmt.Sprintf("%d", result.Expected),
+			fmt.Sprintf("%d", result.Actual),
+			fmt.Sprintf("%+d", result.Delta()),
+		})
+	}
+	table.Render()
+}
+
+//Print a nice table to stdout showing fields that are mapped differently in different source indexes
+func printConflictTable(conflicts []fieldConflict) {
+	table := tablewriter.NewWriter(os.Stdout)
+	tableHeader := []string{
+		"Destination",
+		"Field",
+		"Types",
+		"Resolution",
+	}
+	table.SetHeader(tableHeader)
+
+	for _, conflict := range conflicts {
+		var fieldTypes []string
+		for fieldType, sources := range conflict.Types {
+			fieldTypes = append(fieldTypes, fmt.Sprintf("%s (%d)", fieldType, len(sources)))
+		}
+		sort.Strings(fieldTypes)
+		table.Append([]string{
+			conflict.DestinationIndex,
+			conflict.Field,
+			strings.Join(fieldTypes, ", "),
+			conflict.Resolution.String(),
+		})
+	}
+	table.Render()
+}
+
+//Print a nice table to stdout showing what the rollup would do
+func printPlanTable(plan []planEntry) {
+	table := tablewriter.NewWriter(os.Stdout)
+	tableHeader := []string{
+		"Source",
+		"Destination",
+		"Records",
+		"Size",
+		"Destination Exists",
+	}
+	table.SetHeader(tableHeader)
+
+	var totalDocs, totalBytes int64
+	for _, entry := range plan {
+		destination := entry.DestinationIndex
+		exists := "no"
+		if entry.DestinationExists {
+			exists = "yes"
+		}
+		if entry.Unparsed {
+			destination = "(date could not be parsed)"
+			exists = ""
+		} else {
+			totalDocs += entry.Documents
+			totalBytes += entry.StoreBytes
+		}
+		table.Append([]string{
+			entry.SourceIndex,
+			destination,
+			fmt.Sprintf("%d", entry.Documents),
+			formatBytes(entry.StoreBytes),
+			exists,
+		})
+	}
+	table.SetFooter([]string{
+		"",
+		"Total",
+		fmt.Sprintf("%d", totalDocs),
+		formatBytes(totalBytes),
+		"",
+	})
+	table.Render()
+}
+
+//Turn a number of bytes into something a human can read
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
 //Print a nice table to stdout showing the benchmark progress
 func printBenchmarkTable(results benchmarkData, iterations int) {
 	var keys benchmarkSets
@@ -138,3 +292,25 @@ func clearConsole() {
 		panic("Your platform is unsupported! I can't clear terminal screen :(")
 	}
 }
+
+//Print how each job in the config file went
+func printJobTable(results []jobResult) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{
+		"Job",
+		"Result",
+		"Time",
+	})
+	for _, result := range results {
+		status := "OK"
+		if result.ExitCode != 0 {
+			status = "FAILED"
+		}
+		table.Append([]string{
+			result.Name,
+			status,
+			result.Elapsed.String(),
+		})
+	}
+	table.Render()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+//Show what the rollup would do without writing anything, and turn the result into an exit code
+//for doMain
+func doPlan(inClient, outClient *elastic.Client, matchingIndexes elasticDailyIndexes, unparsedIndexes []string) int {
+	consoleOut("Building plan...")
+	plan, err := buildPlan(inClient, outClient, matchingIndexes, unparsedIndexes)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	consoleOut("Done\n")
+
+	switch *planFormat {
+	case "json":
+		data, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Println(string(data))
+	default:
+		printPlanTable(plan)
+	}
+	return 0
+}
+
+//Work out where every matching index would be rolled up to, along with how big it is and whether
+//its destination already exists
+func buildPlan(inClient, outClient *elastic.Client, matchingIndexes elasticDailyIndexes, unparsedIndexes []string) ([]planEntry, error) {
+	var plan []planEntry
+	destinations := groupByDestination(matchingIndexes)
+
+	var destinationsSorted []string
+	for outIdxName := range destinations {
+		destinationsSorted = append(destinationsSorted, outIdxName)
+	}
+	sort.Strings(destinationsSorted)
+
+	for _, outIdxName := range destinationsSorted {
+		exists, err := outClient.IndexExists(outIdxName).Do()
+		if err != nil {
+			return plan, fmt.Errorf("could not check %s exists: %v", outIdxName, err)
+		}
+
+		sources := destinations[outIdxName]
+		sort.Strings(sources)
+		stats, err := getIndexSizes(inClient, sources)
+		if err != nil {
+			return plan, err
+		}
+		for _, idx := range sources {
+			entry := stats[idx]
+			if timeDestinations != nil { //Only some of the source goes to this destination, so we share out its size
+				documents := timeDestinations[idx][outIdxName]
+				if entry.Documents > 0 {
+					entry.StoreBytes = entry.StoreBytes * documents / entry.Documents
+				}
+				entry.Documents = documents
+			}
+			entry.DestinationIndex = outIdxName
+			entry.DestinationExists = exists
+			plan = append(plan, entry)
+		}
+	}
+
+	//Indexes that matched the filter but whose names we couldn't get a date out of are listed at the
+	//end, because they are usually a sign that the filter or the pattern is wrong
+	if len(unparsedIndexes) > 0 {
+		sort.Strings(unparsedIndexes)
+		stats, err := getIndexSizes(inClient, unparsedIndexes)
+		if err != nil {
+			return plan, err
+		}
+		for _, idx := range unparsedIndexes {
+			entry := stats[idx]
+			entry.Unparsed = true
+			plan = append(plan, entry)
+		}
+	}
+
+	return plan, nil
+}
+
+//Get the number of documents and size on disk of the primary shards of each index. The stats are asked
+//for a chunk of indexes at a time, so that we don't end up with an enormous URL.
+func getIndexSizes(client *elastic.Client, indexes []string) (map[string]planEntry, error) {
+	sizes := make(map[string]planEntry)
+	for _, chunk := range indexChunks(indexes) {
+		if err := getChunkSizes(client, chunk, sizes); err != nil {
+			return sizes, err
+		}
+	}
+	return sizes, nil
+}
+
+//Add the sizes of a single chunk of indexes to sizes
+func getChunkSizes(client *elastic.Client, indexes []string, sizes map[string]planEntry) error {
+	response, err := client.IndexStats(indexes...).Metric("docs", "store").Do()
+	if err != nil {
+		return fmt.Errorf("could not get index stats: %v", err)
+	}
+	for _, idx := range indexes {
+		entry := planEntry{SourceIndex: idx}
+		if stats := response.Indices[idx]; stats != nil && stats.Primaries != nil {
+			if stats.Primaries.Docs != nil {
+				entry.Documents = stats.Primaries.Docs.Count
+			}
+			if stats.Primaries.Store != nil {
+				entry.StoreBytes = stats.Primaries.Store.SizeInBytes
+			}
+		}
+		//If we are only rolling up some of the documents, show how many of them there are
+		if rollupQuery != nil {
+			if entry.Documents, err = countSource(client, idx); err != nil {
+				return fmt.Errorf("could not count %s: %v", idx, err)
+			}
+		}
+		sizes[idx] = entry
+	}
+	return nil
+}
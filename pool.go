@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+//The orders that source indexes can be read in
+const (
+	orderName        = "name"        //Alphabetical order of the source indexes
+	orderLargest     = "largest"     //Biggest source indexes first, so that we aren't left waiting on a big one at the end
+	orderDestination = "destination" //Grouped by destination, so that each destination is finished as soon as possible
+)
+
+//workerPool reads source indexes with a fixed number of workers, which can be changed while it is running
+type workerPool struct {
+	mutex   sync.Mutex
+	tasks   []rollupTask
+	size    int //How many workers we want
+	workers int //How many workers there are
+	busy    int //How many workers are reading an index
+	work    func(rollupTask)
+	ctx     context.Context //Once this is cancelled no more tasks are started
+}
+
+var (
+	pool      *workerPool //The pool of the rollup that is running, if there is one
+	poolMutex sync.Mutex
+)
+
+//Start a pool that works through the tasks in order, until they run out or ctx is cancelled
+func startWorkerPool(ctx context.Context, size int, tasks []rollupTask, work func(rollupTask)) *workerPool {
+	p := &workerPool{
+		tasks: tasks,
+		work:  work,
+		ctx:   ctx,
+	}
+	p.Resize(size)
+	poolMutex.Lock()
+	pool = p
+	poolMutex.Unlock()
+	return p
+}
+
+//The pool of the rollup that is running, or nil if there isn't one
+func currentPool() *workerPool {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+	return pool
+}
+
+//Forget about the pool once the rollup has finished
+func stopWorkerPool() {
+	poolMutex.Lock()
+	pool = nil
+	poolMutex.Unlock()
+}
+
+//Change the number of workers. New workers start straight away, but if there are fewer workers now, the
+//extra ones stop once they have finished the index they are reading.
+func (p *workerPool) Resize(size int) {
+	if size < 1 {
+		size = 1
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.size = size
+	for p.workers < p.size && len(p.tasks) > 0 && p.ctx.Err() == nil {
+		p.workers++
+		go p.worker()
+	}
+}
+
+//The number of workers we want, and the number that are reading an index right now
+func (p *workerPool) Size() (int, int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.size, p.busy
+}
+
+//Whether the pool has been told to stop and every worker has finished what it was doing
+func (p *workerPool) Stopped() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.ctx.Err() != nil && p.workers == 0
+}
+
+//Take tasks off the queue until there are none left, or there are more workers than we want
+func (p *workerPool) worker() {
+	for {
+		p.mutex.Lock()
+		if p.workers > p.size || len(p.tasks) == 0 || p.ctx.Err() != nil {
+			p.workers--
+			p.mutex.Unlock()
+			return
+		}
+		task := p.tasks[0]
+		p.tasks = p.tasks[1:]
+		p.busy++
+		p.mutex.Unlock()
+
+		p.work(task)
+
+		p.mutex.Lock()
+		p.busy--
+		p.mutex.Unlock()
+	}
+}
+
+//Put the tasks in the order given by the order option. They start off in name order.
+func orderTasks(client *elastic.Client, tasks []rollupTask) error {
+	switch *readOrder {
+	case orderName:
+	case orderDestination:
+		sort.Stable(tasksByDestination(tasks))
+	case orderLargest:
+		var indexes []string //getIndexSizes asks for these a chunk at a time
+		for _, task := range tasks {
+			indexes = append(indexes, task.SourceIndex)
+		}
+		sizes, err := getIndexSizes(client, indexes)
+		if err != nil {
+			return err
+		}
+		for i := range tasks {
+			tasks[i].StoreBytes = sizes[tasks[i].SourceIndex].StoreBytes
+		}
+		sort.Stable(tasksBySize(tasks))
+	default:
+		return fmt.Errorf("unknown order %q", *readOrder)
+	}
+	return nil
+}
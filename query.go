@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+//Turn the -query option into a query. Anything that looks like JSON is used as a raw query, anything
+//else is treated as a query_string expression, like you would type into Kibana.
+func parseQuery(s string) (elastic.Query, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(s, "{") {
+		var body interface{}
+		if err := json.Unmarshal([]byte(s), &body); err != nil {
+			return nil, fmt.Errorf("could not parse JSON query: %v", err)
+		}
+		return elastic.NewRawStringQuery(s), nil
+	}
+	return elastic.NewQueryStringQuery(s), nil
+}
+
+//Build the query we scroll each source index with. This is the -query option, if there is one, plus
+//a filter to skip the documents we have already read if we are resuming. It returns nil if there is
+//nothing to filter on.
+func sourceQuery(lastSort interface{}) elastic.Query {
+	if lastSort == nil {
+		return rollupQuery
+	}
+	resumeFilter := elastic.NewRangeQuery(stateSortField).Gt(lastSort)
+	if rollupQuery == nil {
+		return resumeFilter
+	}
+	return elastic.NewBoolQuery().Must(rollupQuery).Filter(resumeFilter)
+}
+
+//Count the documents in a source index that will be rolled up
+func countSource(client *elastic.Client, idx string) (int64, error) {
+	count := client.Count(idx)
+	if rollupQuery != nil {
+		count = count.Query(rollupQuery)
+	}
+	return count.Do()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+//The things we can do with a source index once its destination has been verified
+const (
+	retireClose    = "close"
+	retireDelete   = "delete"
+	retireSnapshot = "snapshot" //Snapshot to a repository, then delete
+)
+
+//Close or delete the source indexes whose destinations have passed verification. Source indexes
+//that are newer than the grace period are left alone, as are any with a destination that didn't verify.
+func retireSources(client *elastic.Client, results []verifyResult, matchingIndexes elasticDailyIndexes) error {
+	cutoff := time.Now().Add(-*gracePeriod)
+	failed := make(map[string]bool) //When routing by the time field, a source can have more than one destination
+	for _, result := range results {
+		if result.Delta() != 0 {
+			for _, idx := range result.SourceIndexes {
+				failed[idx] = true
+			}
+		}
+	}
+
+	var toRetire []string
+	destinations := make(map[string]string)
+	for _, result := range results {
+		if result.Delta() != 0 {
+			continue
+		}
+		for _, idx := range result.SourceIndexes {
+			if _, seen := destinations[idx]; seen || failed[idx] {
+				continue
+			}
+			//An index with no date has no documents to tell us how old it is, so we leave it alone
+			if !matchingIndexes[idx].IsZero() && matchingIndexes[idx].Before(cutoff) {
+				toRetire = append(toRetire, idx)
+				destinations[idx] = result.DestinationIndex
+			}
+		}
+	}
+	if len(toRetire) == 0 {
+		consoleOut("No source indexes to %s\n", *onSuccess)
+		return nil
+	}
+
+	fmt.Printf("The following %d source indexes will be %s:\n", len(toRetire), retireDescription())
+	for _, idx := range toRetire {
+		fmt.Printf("  %s\n", idx)
+	}
+	if !*assumeYes && !confirm("Type yes to continue: ") {
+		fmt.Println("Leaving source indexes alone")
+		return nil
+	}
+
+	for _, idx := range toRetire {
+		if err := retireIndex(client, idx, destinations[idx], matchingIndexes[idx]); err != nil {
+			log.Printf("Could not %s %s: %v", *onSuccess, idx, err)
+			return err
+		}
+	}
+	return nil
+}
+
+//Describe what we are about to do, for the confirmation prompt
+func retireDescription() string {
+	switch *onSuccess {
+	case retireClose:
+		return "closed"
+	case retireSnapshot:
+		if *aliasCutover {
+			return fmt.Sprintf("snapshotted to %s and replaced with aliases", *snapshotRepo)
+		}
+		return fmt.Sprintf("snapshotted to %s and deleted", *snapshotRepo)
+	default:
+		if *aliasCutover {
+			return "replaced with aliases"
+		}
+		return "deleted"
+	}
+}
+
+//Ask the user a question on the console, returning true if they answered yes
+func confirm(prompt string) bool {
+	fmt.Print(prompt)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	return strings.ToLower(strings.TrimSpace(answer)) == "yes"
+}
+
+//Close, delete or snapshot a single source index, logging what we did
+func retireIndex(client *elastic.Client, idx, outIdxName string, indexDate time.Time) error {
+	switch *onSuccess {
+	case retireClose:
+		if _, err := client.CloseIndex(idx).Do(); err != nil {
+			return err
+		}
+		log.Printf("Closed %s", idx)
+	case retireSnapshot:
+		if err := snapshotIndex(client, idx); err != nil {
+			return err
+		}
+		log.Printf("Snapshotted %s to %s/%s", idx, *snapshotRepo, idx)
+		fallthrough
+	case retireDelete:
+		if *aliasCutover {
+			return replaceWithAlias(client, idx, outIdxName, indexDate)
+		}
+		if _, err := client.DeleteIndex(idx).Do(); err != nil {
+			return err
+		}
+		log.Printf("Deleted %s", idx)
+	}
+	return nil
+}
+
+//Take a snapshot of a single index into the snapshot repository, named after the index. We wait
+//for the snapshot to finish so that we know it is safe to delete the index afterwards.
+func snapshotIndex(client *elastic.Client, idx string) error {
+	path := fmt.Sprintf("/_snapshot/%s/%s", url.QueryEscape(*snapshotRepo), url.QueryEscape(idx))
+	params := url.Values{"wait_for_completion": []string{"true"}}
+	body := map[string]interface{}{
+		"indices":              idx,
+		"include_global_state": false,
+	}
+	res, err := client.PerformRequest("PUT", path, params, body)
+	if err != nil {
+		return err
+	}
+
+	var snapshot struct {
+		Snapshot struct {
+			State string `json:"state"`
+		} `json:"snapshot"`
+	}
+	if err := json.Unmarshal(res.Body, &snapshot); err != nil {
+		return err
+	}
+	if snapshot.Snapshot.State != "SUCCESS" {
+		return fmt.Errorf("snapshot finished with state %s", snapshot.Snapshot.State)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+//The field we add to every sampled document, so that counts can be scaled back up
+const sampleRateField = "sample_rate"
+
+//Parse the sample option. It is either a single rate for every destination, e.g. "10", or a list of
+//destination patterns and rates, e.g. "netflow-2015*=100,netflow-2016*=10".
+func parseSampleRules(s string) ([]sampleRule, error) {
+	var rules []sampleRule
+	for _, part := range fieldList(s) {
+		rule := sampleRule{Pattern: "*"}
+		rate := part
+		if i := strings.LastIndex(part, "="); i >= 0 {
+			rule.Pattern = strings.TrimSpace(part[:i])
+			rate = strings.TrimSpace(part[i+1:])
+		}
+		n, err := strconv.Atoi(rate)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%q is not a whole number of 1 or more", rate)
+		}
+		rule.Rate = n
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+//The sample rate for a destination index, from the first pattern it matches. Destinations that don't
+//match anything are not sampled, which is a rate of 1.
+func sampleRate(outIndex string) int {
+	for _, rule := range sampleRules {
+		if matchesAnyField([]string{rule.Pattern}, outIndex) {
+			return rule.Rate
+		}
+	}
+	return 1
+}
+
+//Decide whether a document is in the sample. We hash the document ID, or the sample field if there is
+//one, so that the same documents are picked every time. Documents without the sample field are picked by
+//their ID.
+func keepSample(doc *elastic.SearchHit, rate int) bool {
+	if rate <= 1 {
+		return true
+	}
+
+	key := []byte(doc.Id)
+	if *sampleField != "" && doc.Source != nil {
+		var source map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(*doc.Source))
+		decoder.UseNumber()
+		if err := decoder.Decode(&source); err == nil {
+			if value, ok := getField(source, strings.Split(*sampleField, ".")); ok {
+				key, _ = json.Marshal(value)
+			}
+		}
+	}
+
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()%uint64(rate) == 0
+}
+
+//Add the sample rate field to every type in a destination's mappings
+func addSampleRateMapping(mappings map[string]interface{}) {
+	for _, typeMapping := range mappings {
+		typeMappingMap, ok := typeMapping.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		properties, ok := typeMappingMap["properties"].(map[string]interface{})
+		if !ok {
+			properties = make(map[string]interface{})
+			typeMappingMap["properties"] = properties
+		}
+		properties[sampleRateField] = map[string]interface{}{"type": "integer"}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"gopkg.in/olivere/elastic.v3/backoff"
+)
+
+//runContext is cancelled when we are asked to stop. Until main sets it up it can never be cancelled.
+var runContext = context.Background()
+
+//Catch Ctrl-C and SIGTERM. The first one cancels the context that is returned, which tells the readers
+//to stop so that what has been read can be flushed and saved. The second one stops us straight away.
+func notifyShutdown() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		consoleOut("Stopping, press Ctrl-C again to stop immediately\n")
+		cancel()
+		<-signals
+		fmt.Println("Stopping immediately")
+		os.Exit(1)
+	}()
+	return ctx
+}
+
+//The same as backoff.RetryNotify, except that it gives up as soon as ctx is cancelled, rather than
+//waiting out the backoff or trying again
+func retryContext(ctx context.Context, operation backoff.Operation, b backoff.Backoff, notify backoff.Notify) error {
+	b.Reset()
+	for {
+		err := operation()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		next := b.Next()
+		if next == backoff.Stop {
+			return err
+		}
+		if notify != nil {
+			notify(err, next)
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(next):
+		}
+	}
+}
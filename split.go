@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+	"gopkg.in/olivere/elastic.v3/backoff"
+)
+
+//The ways a source index can be split into parts that are read at the same time
+const (
+	splitShards = "shards" //One part for each primary shard
+	splitTime   = "time"   //Equal time ranges of the splitfield option
+)
+
+//Describe the split options, so that we can tell whether the parts in a state file were split the same way
+func splitDescription() string {
+	switch *splitBy {
+	case splitShards:
+		return splitShards
+	case splitTime:
+		return fmt.Sprintf("%s %s %d", splitTime, *splitField, *splitParts)
+	}
+	return ""
+}
+
+//Work out the parts that a source index is read in
+func splitIndex(client *elastic.Client, idx string) ([]rollupPart, error) {
+	switch *splitBy {
+	case splitShards:
+		return splitByShard(client, idx)
+	case splitTime:
+		return splitByTime(client, idx)
+	}
+	return nil, fmt.Errorf("unknown split %q", *splitBy)
+}
+
+//One part for each primary shard of the index, which is read with a search preference of that shard
+func splitByShard(client *elastic.Client, idx string) ([]rollupPart, error) {
+	response, err := client.IndexGetSettings(idx).FlatSettings(true).Do()
+	if err != nil {
+		return nil, fmt.Errorf("could not get settings of %s: %v", idx, err)
+	}
+	if response[idx] == nil {
+		return nil, fmt.Errorf("could not get settings of %s", idx)
+	}
+	shardCount, err := strconv.Atoi(fmt.Sprint(response[idx].Settings["index.number_of_shards"]))
+	if err != nil {
+		return nil, fmt.Errorf("could not get the number of shards of %s: %v", idx, err)
+	}
+
+	parts := make([]rollupPart, shardCount)
+	for n := range parts {
+		parts[n].Preference = fmt.Sprintf("_shards:%d", n)
+	}
+	return parts, nil
+}
+
+//Split the time between the oldest and newest documents into equal ranges. The first part also has
+//everything without the field, so that no document is left out.
+func splitByTime(client *elastic.Client, idx string) ([]rollupPart, error) {
+	search := client.Search(idx).Size(0).
+		Aggregation("oldest", elastic.NewMinAggregation().Field(*splitField)).
+		Aggregation("newest", elastic.NewMaxAggregation().Field(*splitField))
+	if rollupQuery != nil {
+		search = search.Query(rollupQuery)
+	}
+	results, err := search.Do()
+	if err != nil {
+		return nil, fmt.Errorf("could not get the times of the documents in %s: %v", idx, err)
+	}
+
+	oldest, foundOldest := results.Aggregations.Min("oldest")
+	newest, foundNewest := results.Aggregations.Max("newest")
+	if !foundOldest || !foundNewest || oldest.Value == nil || newest.Value == nil {
+		return []rollupPart{{}}, nil //Nothing has the field, so there's nothing to split on
+	}
+	start, end := int64(*oldest.Value), int64(*newest.Value)
+	step := (end - start) / int64(*splitParts)
+	if step < 1 {
+		return []rollupPart{{}}, nil
+	}
+
+	var parts []rollupPart
+	var from *time.Time
+	for n := 1; n < *splitParts; n++ {
+		to := time.Unix(0, (start+int64(n)*step)*int64(time.Millisecond)).UTC()
+		parts = append(parts, rollupPart{From: from, To: &to})
+		from = &to
+	}
+	parts = append(parts, rollupPart{From: from})
+	return parts, nil
+}
+
+//Limit a query to the documents in a part
+func partQuery(query elastic.Query, part rollupPart) elastic.Query {
+	var partFilter elastic.Query
+	switch {
+	case part.From != nil:
+		timeRange := elastic.NewRangeQuery(*splitField).Format("epoch_millis").Gte(epochMillis(*part.From))
+		if part.To != nil {
+			timeRange = timeRange.Lt(epochMillis(*part.To))
+		}
+		partFilter = timeRange
+	case part.To != nil:
+		//Anything that isn't after the start of the next part, which includes documents without the field
+		partFilter = elastic.NewBoolQuery().MustNot(elastic.NewRangeQuery(*splitField).Format("epoch_millis").Gte(epochMillis(*part.To)))
+	default:
+		return query
+	}
+	if query == nil {
+		return partFilter
+	}
+	return elastic.NewBoolQuery().Must(query).Filter(partFilter)
+}
+
+func epochMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+//Read every part of a source index at the same time, and return the total number of documents read. The
+//parts are kept in its stat, so that the progress table can add them up and -resume can carry on each
+//one from where it got to.
+func rollupParts(ctx context.Context, c chan<- insertDoc, inClient *elastic.Client, inIndex, outIndex string) (int, error) {
+	readMutex.Lock()
+	parts := readDocs[inIndex].Parts
+	readMutex.Unlock()
+	if len(parts) == 0 {
+		var err error
+		if parts, err = splitIndex(inClient, inIndex); err != nil {
+			return 0, err
+		}
+		readMutex.Lock()
+		docStat := readDocs[inIndex]
+		docStat.Split = splitDescription()
+		docStat.Parts = parts
+		readDocs[inIndex] = docStat
+		readMutex.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(parts))
+	for n := range parts {
+		if parts[n].Done && parts[n].Error == "" { //Finished on an earlier run
+			continue
+		}
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			errs[n] = rollupPartOf(ctx, c, inClient, inIndex, outIndex, n)
+		}(n)
+	}
+	wg.Wait()
+
+	readMutex.Lock()
+	total := readDocs[inIndex].ReadCount
+	readMutex.Unlock()
+	for n, err := range errs {
+		if err != nil {
+			return total, fmt.Errorf("part %d: %v", n+1, err)
+		}
+	}
+	return total, nil
+}
+
+//Read a single part of a source index, trying again if it fails in the same way as rollupIndex does
+func rollupPartOf(ctx context.Context, c chan<- insertDoc, inClient *elastic.Client, inIndex, outIndex string, n int) error {
+	readMutex.Lock()
+	part := readDocs[inIndex].Parts[n]
+	readMutex.Unlock()
+	i := part.ReadCount
+	lastSort := part.LastSort
+
+	updatePart := func(update func(*rollupPart)) {
+		readMutex.Lock()
+		docStat := readDocs[inIndex]
+		update(&docStat.Parts[n])
+		docStat.ReadCount = 0
+		docStat.Retries = 0
+		for _, part := range docStat.Parts {
+			docStat.ReadCount += part.ReadCount
+			docStat.Retries += part.Retries
+		}
+		readDocs[inIndex] = docStat
+		readMutex.Unlock()
+	}
+
+	var err error
+	defer func() {
+		updatePart(func(p *rollupPart) {
+			p.Done = true
+			p.ReadCount = i
+			p.LastSort = lastSort
+			p.Error = ""
+			if ctx.Err() != nil { //Stopped rather than failed, so this part can be resumed
+				p.Done = false
+			} else if err != nil {
+				p.Error = err.Error()
+			}
+		})
+	}()
+
+	startCount := i
+	attempt := func() error {
+		if lastSort == nil {
+			i = startCount
+		}
+		return scrollIndex(ctx, c, inClient, inIndex, outIndex, part, &i, &lastSort, nil, func(count int, sort interface{}) {
+			updatePart(func(p *rollupPart) {
+				p.ReadCount = count
+				p.LastSort = sort
+			})
+		})
+	}
+	retryNotify := func(err error, wait time.Duration) {
+		updatePart(func(p *rollupPart) {
+			p.Error = err.Error()
+			p.Retries++
+		})
+		readMutex.Lock()
+		docStat := readDocs[inIndex]
+		docStat.Error = fmt.Sprintf("part %d: %v", n+1, err)
+		readDocs[inIndex] = docStat
+		readMutex.Unlock()
+	}
+	policy := backoff.NewExponentialBackoff(time.Second, 2*time.Minute).SendStop(true)
+	err = retryContext(ctx, attempt, policy, retryNotify)
+	return err
+}
+
+//How many of the parts of an index have been read, for the progress table
+func partsDone(parts []rollupPart) int {
+	done := 0
+	for _, part := range parts {
+		if part.Done && part.Error == "" {
+			done++
+		}
+	}
+	return done
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+//The field we sort on when we are keeping state. It needs to be unique per document so that we
+//can carry on from the last document we saw without skipping or doubling up on anything.
+const stateSortField = "_uid"
+
+//Load a previously saved state file. A missing file is not an error, it just means we haven't
+//done anything yet.
+func loadState(path string) (rollupState, error) {
+	state := make(rollupState)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+//Write the current progress of all our readers out to the state file. We write to a temporary
+//file first and then move it into place, so that a crash halfway through a write doesn't leave
+//us with a corrupt state file.
+func saveState(path string) error {
+	readMutex.Lock()
+	data, err := json.MarshalIndent(rollupState(readDocs), "", "  ")
+	readMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
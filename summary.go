@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+//The field in each summary document that holds the number of documents it summarizes
+const summaryCountField = "doc_count"
+
+//The metrics that can be worked out for each bucket
+var summaryMetricTypes = map[string]bool{
+	"sum":         true,
+	"min":         true,
+	"max":         true,
+	"avg":         true,
+	"count":       true, //Number of values of the field
+	"cardinality": true, //Number of distinct values of the field
+}
+
+//Load the summary file given on the command line, if there is one
+func loadSummary() error {
+	if *summarizeFile == "" {
+		return nil
+	}
+	spec, err := loadSummarySpec(*summarizeFile)
+	if err != nil {
+		return fmt.Errorf("Summary (summarize) could not be loaded: %v", err)
+	}
+	summary = spec
+	return nil
+}
+
+//Load and check a summary file
+func loadSummarySpec(path string) (*summarySpec, error) {
+	spec := &summarySpec{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, err
+	}
+
+	if spec.TimestampField == "" {
+		return nil, fmt.Errorf("timestamp_field must be given")
+	}
+	if spec.interval, err = parseInterval(spec.Interval); err != nil {
+		return nil, err
+	}
+	if spec.Type == "" {
+		spec.Type = "summary"
+	}
+
+	//Every field we write has to have its own name
+	names := map[string]bool{spec.TimestampField: true, summaryCountField: true}
+	for _, field := range spec.GroupBy {
+		if names[field] {
+			return nil, fmt.Errorf("%s is used more than once", field)
+		}
+		names[field] = true
+	}
+	for i, metric := range spec.Metrics {
+		if metric.Field == "" {
+			return nil, fmt.Errorf("metric %d has no field", i+1)
+		}
+		if !summaryMetricTypes[metric.Type] {
+			return nil, fmt.Errorf("metric %d (%s) has unknown type %q", i+1, metric.Field, metric.Type)
+		}
+		if metric.Name == "" {
+			spec.Metrics[i].Name = strings.Replace(metric.Field, ".", "_", -1) + "_" + metric.Type
+		}
+		if names[spec.Metrics[i].Name] {
+			return nil, fmt.Errorf("%s is used more than once", spec.Metrics[i].Name)
+		}
+		names[spec.Metrics[i].Name] = true
+	}
+	return spec, nil
+}
+
+//Parse an interval such as 30s, 5m, 1h, 1d or 1w
+func parseInterval(s string) (time.Duration, error) {
+	var interval time.Duration
+	var err error
+	switch {
+	case strings.HasSuffix(s, "d"), strings.HasSuffix(s, "w"):
+		var n int
+		n, err = strconv.Atoi(s[:len(s)-1])
+		interval = time.Duration(n) * 24 * time.Hour
+		if strings.HasSuffix(s, "w") {
+			interval *= 7
+		}
+	default:
+		interval, err = time.ParseDuration(s)
+	}
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("interval %q is not valid", s)
+	}
+	return interval, nil
+}
+
+//The fields of the source documents that we need to build the summaries
+func (s *summarySpec) fields() []string {
+	fields := append([]string{s.TimestampField}, s.GroupBy...)
+	for _, metric := range s.Metrics {
+		fields = append(fields, metric.Field)
+	}
+	return fields
+}
+
+//Build the mappings for the summary documents. The timestamp is a date, the counts are longs and the
+//other metrics are doubles. Group by fields are mapped the same way as they are in the source indexes.
+func (s *summarySpec) mappings(sourceMappings map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	setMappingProperty(properties, s.TimestampField, map[string]interface{}{"type": "date"})
+	setMappingProperty(properties, summaryCountField, map[string]interface{}{"type": "long"})
+	for _, field := range s.GroupBy {
+		path := strings.Split(field, ".")
+		for _, typeMapping := range sourceMappings {
+			typeMappingMap, _ := typeMapping.(map[string]interface{})
+			if mapping, ok := mappingParentProperties(typeMappingMap, path)[path[len(path)-1]]; ok {
+				setMappingProperty(properties, field, mapping)
+				break
+			}
+		}
+	}
+	for _, metric := range s.Metrics {
+		metricType := "double"
+		if metric.Type == "count" || metric.Type == "cardinality" {
+			metricType = "long"
+		}
+		setMappingProperty(properties, metric.Name, map[string]interface{}{"type": metricType})
+	}
+
+	return map[string]interface{}{
+		s.Type: map[string]interface{}{"properties": properties},
+	}
+}
+
+//Add the mapping of a dotted field path to a properties map, creating any objects along the way
+func setMappingProperty(properties map[string]interface{}, field string, mapping interface{}) {
+	path := strings.Split(field, ".")
+	for _, name := range path[:len(path)-1] {
+		object, ok := properties[name].(map[string]interface{})
+		if !ok {
+			object = map[string]interface{}{"properties": make(map[string]interface{})}
+			properties[name] = object
+		}
+		properties = object["properties"].(map[string]interface{})
+	}
+	properties[path[len(path)-1]] = mapping
+}
+
+//The running totals for one time bucket and set of group by values
+type summaryBucket struct {
+	Timestamp time.Time
+	Group     []interface{}
+	Count     int64
+	Metrics   []metricValue //In the same order as the metrics in the summary file
+}
+
+type metricValue struct {
+	Sum      float64
+	Min      float64
+	Max      float64
+	Count    int64
+	Distinct map[string]bool
+}
+
+//summaryAccumulator holds the buckets for a single source index while it is being read, keyed by the
+//bucket time and group by values
+type summaryAccumulator map[string]*summaryBucket
+
+//Add a document to the bucket it belongs in
+func (a summaryAccumulator) add(source *json.RawMessage) error {
+	if source == nil {
+		return fmt.Errorf("document has no source")
+	}
+	var doc map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(*source))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return err
+	}
+
+	value, ok := getField(doc, strings.Split(summary.TimestampField, "."))
+	if !ok {
+		return fmt.Errorf("document has no %s", summary.TimestampField)
+	}
+	timestamp, err := parseTimestamp(summary.TimestampField, value, summary.TimestampFormat)
+	if err != nil {
+		return err
+	}
+	timestamp = timestamp.UTC().Truncate(summary.interval)
+
+	group := make([]interface{}, len(summary.GroupBy))
+	for i, field := range summary.GroupBy {
+		group[i], _ = getField(doc, strings.Split(field, "."))
+	}
+	key, err := json.Marshal(append([]interface{}{timestamp.Unix()}, group...))
+	if err != nil {
+		return err
+	}
+
+	bucket, ok := a[string(key)]
+	if !ok {
+		bucket = &summaryBucket{
+			Timestamp: timestamp,
+			Group:     group,
+			Metrics:   make([]metricValue, len(summary.Metrics)),
+		}
+		a[string(key)] = bucket
+	}
+	bucket.Count++
+	for i, metric := range summary.Metrics {
+		if value, ok := getField(doc, strings.Split(metric.Field, ".")); ok {
+			bucket.Metrics[i].add(metric.Type, value)
+		}
+	}
+	return nil
+}
+
+//Add a value to a metric. Every value in an array is added, the same as ElasticSearch does, and values
+//that aren't numbers are only counted.
+func (v *metricValue) add(metricType string, value interface{}) {
+	if values, ok := value.([]interface{}); ok {
+		for _, value := range values {
+			v.add(metricType, value)
+		}
+		return
+	}
+	if value == nil {
+		return
+	}
+
+	switch metricType {
+	case "count":
+		v.Count++
+	case "cardinality":
+		key, _ := json.Marshal(value)
+		if v.Distinct == nil {
+			v.Distinct = make(map[string]bool)
+		}
+		v.Distinct[string(key)] = true
+	default:
+		f, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+		if err != nil {
+			return
+		}
+		if v.Count == 0 || f < v.Min {
+			v.Min = f
+		}
+		if v.Count == 0 || f > v.Max {
+			v.Max = f
+		}
+		v.Sum += f
+		v.Count++
+	}
+}
+
+//The final value of a metric. Metrics with nothing to work from are nil, so they are left out of the document.
+func (v metricValue) result(metricType string) interface{} {
+	switch metricType {
+	case "count":
+		return v.Count
+	case "cardinality":
+		return len(v.Distinct)
+	case "sum":
+		return v.Sum
+	}
+	if v.Count == 0 {
+		return nil
+	}
+	switch metricType {
+	case "min":
+		return v.Min
+	case "max":
+		return v.Max
+	}
+	return v.Sum / float64(v.Count)
+}
+
+//Turn the buckets into summary documents ready to be indexed, with the index of each hit set to the
+//destination it goes to. The document IDs are made from the source index and the bucket, so that
+//summarizing the same index again overwrites what was there before.
+func (a summaryAccumulator) documents(sourceIndex, outIndex string) ([]*elastic.SearchHit, error) {
+	var keys []string
+	for key := range a {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var hits []*elastic.SearchHit
+	for _, key := range keys {
+		bucket := a[key]
+		doc := make(map[string]interface{})
+		setField(doc, strings.Split(summary.TimestampField, "."), bucket.Timestamp.Format(time.RFC3339))
+		for i, field := range summary.GroupBy {
+			if bucket.Group[i] != nil {
+				setField(doc, strings.Split(field, "."), bucket.Group[i])
+			}
+		}
+		doc[summaryCountField] = bucket.Count
+		for i, metric := range summary.Metrics {
+			if result := bucket.Metrics[i].result(metric.Type); result != nil {
+				setField(doc, strings.Split(metric.Name, "."), result)
+			}
+		}
+
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return hits, err
+		}
+		source := json.RawMessage(data)
+		id := sha1.Sum([]byte(sourceIndex + "\x00" + key))
+		if *timeField != "" { //Each bucket goes to the destination for its own time
+			outIndex = destinationIndexName(sourceIndex, bucket.Timestamp)
+		}
+		hits = append(hits, &elastic.SearchHit{
+			Index:  outIndex,
+			Type:   summary.Type,
+			Id:     hex.EncodeToString(id[:]),
+			Source: &source,
+		})
+	}
+	return hits, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//rateLimiter is a token bucket that is shared by all the readers. It holds up to a second's worth of
+//tokens, and callers that take more than there are wait until the bucket has filled back up to cover them.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   int //Tokens per second, or 0 for no limit
+	tokens float64
+	last   time.Time //When tokens were last added
+}
+
+var (
+	docLimiter  = &rateLimiter{} //Documents per second, from the max-docs-per-sec option
+	byteLimiter = &rateLimiter{} //Bytes of document source per second, from the max-bytes-per-sec option
+)
+
+//Change the rate. This can be done while documents are being read, and applies to the next document.
+func (l *rateLimiter) SetRate(rate int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.rate = rate
+	l.tokens = float64(rate)
+	l.last = time.Now()
+}
+
+//The current rate, or 0 if there is no limit
+func (l *rateLimiter) Rate() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rate
+}
+
+//Take n tokens out of the bucket, and wait until they have been paid for. It gives up if ctx is cancelled.
+func (l *rateLimiter) Wait(ctx context.Context, n int) error {
+	l.mutex.Lock()
+	if l.rate <= 0 {
+		l.mutex.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	l.mutex.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+//Set the limiters from the options
+func startThrottle() error {
+	if *maxDocsRate < 0 || *maxBytesRate < 0 {
+		return fmt.Errorf("maximum documents (max-docs-per-sec) and bytes (max-bytes-per-sec) per second cannot be negative")
+	}
+	docLimiter.SetRate(*maxDocsRate)
+	byteLimiter.SetRate(*maxBytesRate)
+	return nil
+}
+
+//Wait until we are allowed to send a document on to the bulk inserter
+func throttle(ctx context.Context, source *json.RawMessage) error {
+	if err := docLimiter.Wait(ctx, 1); err != nil {
+		return err
+	}
+	if source == nil {
+		return nil
+	}
+	return byteLimiter.Wait(ctx, len(*source))
+}
+
+//Describe the limits for the progress table, or blank if there aren't any
+func throttleDescription() string {
+	var limits []string
+	if rate := docLimiter.Rate(); rate > 0 {
+		limits = append(limits, fmt.Sprintf("%d documents/sec", rate))
+	}
+	if rate := byteLimiter.Rate(); rate > 0 {
+		limits = append(limits, fmt.Sprintf("%d bytes/sec", rate))
+	}
+	if len(limits) == 0 {
+		return ""
+	}
+	return "Throttled to " + strings.Join(limits, " and ")
+}
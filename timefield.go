@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+//Timestamp formats we try if we haven't been given one. Numbers are always taken to be epoch milliseconds.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+//Work out a time from the value of a timestamp field, using the given Go time layout if there is one
+func parseTimestamp(field string, value interface{}, layout string) (time.Time, error) {
+	str := fmt.Sprint(value)
+	if layout != "" {
+		return time.Parse(layout, str)
+	}
+	if _, ok := value.(string); ok {
+		for _, layout := range timestampLayouts {
+			if t, err := time.Parse(layout, str); err == nil {
+				return t, nil
+			}
+		}
+	}
+	if ms, err := strconv.ParseFloat(str, 64); err == nil {
+		return time.Unix(0, int64(ms)*int64(time.Millisecond)), nil
+	}
+	return time.Time{}, fmt.Errorf("could not parse %s %q", field, str)
+}
+
+//When routing by the time field, find out which destinations the documents in each source index will
+//go to, and how many documents go to each. We ask ElasticSearch for the number of documents in each hour,
+//which is as fine as any outpattern is likely to go, and for the number of documents that don't have the
+//field at all, which can't go anywhere. Indexes without a date in their name are given the time of their
+//newest document, so that the grace period still works.
+func findTimeDestinations(client *elastic.Client, matchingIndexes elasticDailyIndexes) (map[string]map[string]int64, map[string]int64, error) {
+	timeDestinations := make(map[string]map[string]int64)
+	untimedDocs := make(map[string]int64)
+	for idx := range matchingIndexes {
+		histogram := elastic.NewDateHistogramAggregation().Field(*timeField).Interval("hour").MinDocCount(1)
+		search := client.Search(idx).Size(0).
+			Aggregation("times", histogram).
+			Aggregation("untimed", elastic.NewMissingAggregation().Field(*timeField))
+		if rollupQuery != nil {
+			search = search.Query(rollupQuery)
+		}
+		results, err := search.Do()
+		if err != nil {
+			return timeDestinations, untimedDocs, fmt.Errorf("could not get the times of the documents in %s: %v", idx, err)
+		}
+
+		destinations := make(map[string]int64)
+		var newest time.Time
+		if buckets, found := results.Aggregations.DateHistogram("times"); found {
+			for _, bucket := range buckets.Buckets {
+				bucketTime := time.Unix(0, bucket.Key*int64(time.Millisecond)).UTC()
+				destinations[destinationIndexName(idx, bucketTime)] += bucket.DocCount
+				if bucketTime.After(newest) {
+					newest = bucketTime
+				}
+			}
+		}
+		timeDestinations[idx] = destinations
+		if missing, found := results.Aggregations.Missing("untimed"); found && missing.DocCount > 0 {
+			untimedDocs[idx] = missing.DocCount
+		}
+		if matchingIndexes[idx].IsZero() {
+			matchingIndexes[idx] = newest
+		}
+	}
+	return timeDestinations, untimedDocs, nil
+}
+
+//The destination indexes that a source index is rolled up into
+func destinationsOf(idx string, indexDate time.Time) []string {
+	if timeDestinations == nil {
+		return []string{destinationIndexName(idx, indexDate)}
+	}
+	var destinations []string
+	for outIdxName := range timeDestinations[idx] {
+		destinations = append(destinations, outIdxName)
+	}
+	sort.Strings(destinations)
+	return destinations
+}
+
+//Work out the destination of a single document from its time field
+func routeDocument(inIndex string, source *json.RawMessage) (string, error) {
+	if source == nil {
+		return "", fmt.Errorf("document has no source")
+	}
+	var doc map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(*source))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return "", err
+	}
+
+	value, ok := getField(doc, strings.Split(*timeField, "."))
+	if !ok {
+		return "", fmt.Errorf("document has no %s", *timeField)
+	}
+	timestamp, err := parseTimestamp(*timeField, value, "")
+	if err != nil {
+		return "", err
+	}
+	return destinationIndexName(inIndex, timestamp.UTC()), nil
+}
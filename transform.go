@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+//The operations that can be used in a transform file
+const (
+	transformRename    = "rename"    //Move a field to a new name
+	transformSet       = "set"       //Set a field to a constant value
+	transformRemove    = "remove"    //Remove a field
+	transformConvert   = "convert"   //Convert a field to another type, e.g. "123" to 123
+	transformLowercase = "lowercase" //Lowercase a string field
+)
+
+//The types that convert can turn a field into
+var convertTypes = map[string]bool{
+	"long": true, "integer": true, "short": true, "byte": true,
+	"double": true, "float": true,
+	"boolean": true,
+	"string":  true, "text": true, "keyword": true,
+}
+
+//Load the transforms file given on the command line, if there is one
+func loadTransformChain() error {
+	if *transformFile == "" {
+		return nil
+	}
+	steps, err := loadTransforms(*transformFile)
+	if err != nil {
+		return fmt.Errorf("Transforms (transforms) could not be loaded: %v", err)
+	}
+	transformChain = steps
+	return nil
+}
+
+//Load the chain of transforms from a JSON file, which holds an array of steps that are applied to
+//every document in order
+func loadTransforms(path string) ([]transformStep, error) {
+	var steps []transformStep
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return steps, err
+	}
+	if err := json.Unmarshal(data, &steps); err != nil {
+		return steps, err
+	}
+
+	for i, step := range steps {
+		if step.Field == "" {
+			return steps, fmt.Errorf("step %d (%s) has no field", i+1, step.Op)
+		}
+		switch step.Op {
+		case transformSet, transformRemove, transformLowercase:
+		case transformRename:
+			if step.To == "" {
+				return steps, fmt.Errorf("step %d (rename %s) has nothing to rename to", i+1, step.Field)
+			}
+		case transformConvert:
+			if !convertTypes[step.Type] {
+				return steps, fmt.Errorf("step %d (convert %s) has unknown type %q", i+1, step.Field, step.Type)
+			}
+		default:
+			return steps, fmt.Errorf("step %d has unknown op %q", i+1, step.Op)
+		}
+	}
+	return steps, nil
+}
+
+//Make all the changes we need to a document before it is indexed: fixing fields whose mappings
+//conflict between source indexes, running the transforms, and recording the sample rate if it has been
+//sampled. If nothing needs changing, the source is returned as it is without being decoded.
+func processDocument(inIndex string, source *json.RawMessage, sampleRate int) (*json.RawMessage, error) {
+	fixes := fieldFixes[inIndex]
+	if source == nil || (len(fixes) == 0 && len(transformChain) == 0 && sampleRate <= 1) {
+		return source, nil
+	}
+
+	var doc map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(*source))
+	decoder.UseNumber() //Don't lose precision on big numbers by turning them into floats
+	if err := decoder.Decode(&doc); err != nil {
+		return source, err
+	}
+
+	for _, fix := range fixes {
+		fixField(doc, strings.Split(fix.Field, "."), fix)
+	}
+	for i, step := range transformChain {
+		if err := applyTransform(doc, step); err != nil {
+			return source, fmt.Errorf("step %d (%s %s): %v", i+1, step.Op, step.Field, err)
+		}
+	}
+	if sampleRate > 1 {
+		doc[sampleRateField] = sampleRate
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return source, err
+	}
+	newSource := json.RawMessage(data)
+	return &newSource, nil
+}
+
+//Apply a single transform step to a document. Steps on fields that the document doesn't have do nothing,
+//except for set.
+func applyTransform(doc map[string]interface{}, step transformStep) error {
+	path := strings.Split(step.Field, ".")
+	if step.Op == transformSet {
+		setField(doc, path, step.Value)
+		return nil
+	}
+
+	value, ok := getField(doc, path)
+	if !ok {
+		return nil
+	}
+	switch step.Op {
+	case transformRename:
+		deleteField(doc, path)
+		setField(doc, strings.Split(step.To, "."), value)
+	case transformRemove:
+		deleteField(doc, path)
+	case transformConvert:
+		converted, err := convertValue(value, step.Type)
+		if err != nil {
+			return err
+		}
+		setField(doc, path, converted)
+	case transformLowercase:
+		lowered, err := lowercaseValue(value)
+		if err != nil {
+			return err
+		}
+		setField(doc, path, lowered)
+	}
+	return nil
+}
+
+//Get the value of a dotted field path from a document
+func getField(doc map[string]interface{}, path []string) (interface{}, bool) {
+	for _, name := range path[:len(path)-1] {
+		child, ok := doc[name].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		doc = child
+	}
+	value, ok := doc[path[len(path)-1]]
+	return value, ok
+}
+
+//Set the value of a dotted field path in a document, creating any objects along the way
+func setField(doc map[string]interface{}, path []string, value interface{}) {
+	for _, name := range path[:len(path)-1] {
+		child, ok := doc[name].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			doc[name] = child
+		}
+		doc = child
+	}
+	doc[path[len(path)-1]] = value
+}
+
+//Remove a dotted field path from a document
+func deleteField(doc map[string]interface{}, path []string) {
+	for _, name := range path[:len(path)-1] {
+		child, ok := doc[name].(map[string]interface{})
+		if !ok {
+			return
+		}
+		doc = child
+	}
+	delete(doc, path[len(path)-1])
+}
+
+//Convert a value to the given ElasticSearch type, or each value if it is an array. Numbers can be
+//converted from strings and vice versa. A null is left as null, whatever the type.
+func convertValue(value interface{}, fieldType string) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if values, ok := value.([]interface{}); ok {
+		converted := make([]interface{}, len(values))
+		for i := range values {
+			c, err := convertValue(values[i], fieldType)
+			if err != nil {
+				return value, err
+			}
+			converted[i] = c
+		}
+		return converted, nil
+	}
+
+	str := fmt.Sprint(value)
+	switch fieldType {
+	case "long", "integer", "short", "byte":
+		if i, err := strconv.ParseInt(str, 10, 64); err == nil {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(str, 64); err == nil {
+			return int64(f), nil
+		}
+	case "double", "float":
+		if f, err := strconv.ParseFloat(str, 64); err == nil {
+			return f, nil
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(str); err == nil {
+			return b, nil
+		}
+	case "string", "text", "keyword":
+		if _, ok := value.(map[string]interface{}); ok {
+			data, err := json.Marshal(value)
+			return string(data), err
+		}
+		return str, nil
+	default:
+		return value, fmt.Errorf("unknown type %q", fieldType)
+	}
+	return value, fmt.Errorf("cannot convert %q to %s", str, fieldType)
+}
+
+//Lowercase a string, or each string if it is an array. A null is left as null.
+func lowercaseValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return strings.ToLower(v), nil
+	case []interface{}:
+		lowered := make([]interface{}, len(v))
+		for i := range v {
+			l, err := lowercaseValue(v[i])
+			if err != nil {
+				return value, err
+			}
+			lowered[i] = l
+		}
+		return lowered, nil
+	}
+	return value, fmt.Errorf("%v is not a string", value)
+}
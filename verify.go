@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+//Run the verification, retire any source indexes that have been asked for, and turn the result into
+//an exit code for doMain
+func doVerify(inClient, outClient *elastic.Client, matchingIndexes elasticDailyIndexes) int {
+	consoleOut("Verifying document counts...")
+	results, err := verifyRollup(inClient, outClient, matchingIndexes)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	consoleOut("Done\n")
+
+	printVerifyTable(results)
+
+	//Only the sources of destinations that passed will be touched
+	if *onSuccess != "" {
+		if err := retireSources(inClient, results, matchingIndexes); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+
+	for _, result := range results {
+		if result.Delta() != 0 {
+			consoleOut("Document counts do not match, the rollup is not complete\n")
+			return 1
+		}
+	}
+	return 0
+}
+
+//Compare the number of documents in each destination index with the total number of documents
+//in all of the source indexes that are rolled up into it.
+func verifyRollup(inClient, outClient *elastic.Client, matchingIndexes elasticDailyIndexes) ([]verifyResult, error) {
+	destinations := groupByDestination(matchingIndexes)
+
+	var results []verifyResult
+	for outIdxName, sources := range destinations {
+		sort.Strings(sources)
+		result := verifyResult{
+			DestinationIndex: outIdxName,
+			SourceIndexes:    sources,
+		}
+
+		for _, idx := range sources {
+			if timeDestinations != nil { //We already know how many documents in each source have a time for this destination
+				//Documents without a time aren't in any destination, so they count against every destination
+				//of their source. That way the source can't pass verification and be retired without them.
+				result.Expected += timeDestinations[idx][outIdxName] + untimedDocs[idx]
+				continue
+			}
+			count, err := countSource(inClient, idx)
+			if err != nil {
+				return results, fmt.Errorf("could not count %s: %v", idx, err)
+			}
+			result.Expected += count
+		}
+
+		//A destination that doesn't exist has no documents in it, which is a mismatch rather than an error
+		exists, err := outClient.IndexExists(outIdxName).Do()
+		if err != nil {
+			return results, fmt.Errorf("could not check %s exists: %v", outIdxName, err)
+		}
+		if exists {
+			//Make sure everything the bulk inserter has written is visible to the count
+			if _, err := outClient.Refresh(outIdxName).Do(); err != nil {
+				return results, fmt.Errorf("could not refresh %s: %v", outIdxName, err)
+			}
+			count, err := countDestination(outClient, outIdxName)
+			if err != nil {
+				return results, fmt.Errorf("could not count %s: %v", outIdxName, err)
+			}
+			result.Actual = count
+		}
+
+		results = append(results, result)
+	}
+
+	sort.Sort(verifyResults(results))
+	return results, nil
+}
+
+//Count the documents in a destination index. Summary documents each stand for a number of source
+//documents, so we add those up instead.
+func countDestination(client *elastic.Client, idx string) (int64, error) {
+	if summary == nil {
+		return client.Count(idx).Do()
+	}
+	results, err := client.Search(idx).
+		Size(0).
+		Aggregation("docs", elastic.NewSumAggregation().Field(summaryCountField)).
+		Do()
+	if err != nil {
+		return 0, err
+	}
+	sum, found := results.Aggregations.Sum("docs")
+	if !found || sum.Value == nil {
+		return 0, nil
+	}
+	return int64(*sum.Value), nil
+}